@@ -0,0 +1,215 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"kiloproxy/config"
+	"kiloproxy/kilolog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const auditFile = "./audit.log"
+
+type auditEntry struct {
+	Time   time.Time         `json:"time"`
+	Ip     string            `json:"ip"`
+	Action string            `json:"action"`
+	Params map[string]string `json:"params,omitempty"`
+	Result string            `json:"result"`
+}
+
+// auditMut serializes the writes to the audit log
+var auditMut sync.Mutex
+
+// audit records an admin action in the audit log
+func audit(c *gin.Context, action string, err error) {
+	entry := auditEntry{
+		Time:   time.Now(),
+		Ip:     c.RemoteIP(),
+		Action: action,
+		Params: make(map[string]string),
+		Result: "OK",
+	}
+	for k, v := range c.Request.URL.Query() {
+		entry.Params[k] = strings.Join(v, ",")
+	}
+	if err != nil {
+		entry.Result = err.Error()
+	}
+	kilolog.Info("Admin action", action, "from", entry.Ip+":", entry.Result)
+
+	data, e := json.Marshal(entry)
+	if e != nil {
+		kilolog.Err("Failed to write to the audit log:", e)
+		return
+	}
+
+	auditMut.Lock()
+	defer auditMut.Unlock()
+
+	f, e := os.OpenFile(auditFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if e != nil {
+		kilolog.Err("Failed to write to the audit log:", e)
+		return
+	}
+	defer f.Close()
+	_, e = f.Write(append(data, '\n'))
+	if e != nil {
+		kilolog.Err("Failed to write to the audit log:", e)
+	}
+}
+
+// adminHandler wraps an admin action, recording it in the audit log and replying with its
+// result. The action returns the HTTP status and the response.
+func adminHandler(action string, fn func(c *gin.Context) (int, any, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, res, err := fn(c)
+		audit(c, action, err)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		if res == nil {
+			res = gin.H{"status": "OK"}
+		}
+		c.JSON(status, res)
+	}
+}
+
+// adminRouter adds the admin API to the dashboard router
+func adminRouter(r *gin.Engine) {
+	admin := r.Group("/admin", adminAuth)
+
+	admin.POST("/kick", adminHandler("kick", func(c *gin.Context) (int, any, error) {
+		var ids []uint64
+		if v := c.Query("id"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return 400, nil, errors.New("invalid miner id")
+			}
+			if FindConnection(id) == nil {
+				return 404, nil, errors.New("unknown miner")
+			}
+			ids = append(ids, id)
+		} else if v := c.Query("ip"); v != "" {
+			ids = ConnectionsByIP(v)
+		} else {
+			return 400, nil, errors.New("id or ip is required")
+		}
+
+		for _, id := range ids {
+			KickFor(id, "kicked by an admin")
+		}
+		return 200, gin.H{"status": "OK", "kicked": len(ids)}, nil
+	}))
+
+	admin.POST("/ban", adminHandler("ban", func(c *gin.Context) (int, any, error) {
+		ip := net.ParseIP(c.Query("ip"))
+		if ip == nil {
+			return 400, nil, errors.New("invalid ip")
+		}
+		minutes := config.Get().Limits.BanMinutes
+		if v := c.Query("minutes"); v != "" {
+			var err error
+			minutes, err = strconv.Atoi(v)
+			if err != nil || minutes <= 0 {
+				return 400, nil, errors.New("invalid ban duration")
+			}
+		} else if minutes <= 0 {
+			return 400, nil, errors.New("minutes is required")
+		}
+		reason := c.Query("reason")
+		if reason == "" {
+			reason = "banned by an admin"
+		}
+
+		BanIP(ip.String(), time.Duration(minutes)*time.Minute, reason)
+		return 200, nil, nil
+	}))
+	admin.POST("/unban", adminHandler("unban", func(c *gin.Context) (int, any, error) {
+		ip := net.ParseIP(c.Query("ip"))
+		if ip == nil {
+			return 400, nil, errors.New("invalid ip")
+		}
+		if !UnbanIP(ip.String()) {
+			return 404, nil, errors.New("ip is not banned")
+		}
+		return 200, nil, nil
+	}))
+
+	admin.POST("/reconnect", adminHandler("reconnect", func(c *gin.Context) (int, any, error) {
+		id, err := strconv.ParseUint(c.Query("upstream"), 10, 64)
+		if err != nil {
+			return 400, nil, errors.New("invalid upstream id")
+		}
+		err = ReconnectUpstream(id)
+		if err != nil {
+			return 404, nil, err
+		}
+		return 200, nil, nil
+	}))
+
+	admin.POST("/pool", adminHandler("switch_pool", func(c *gin.Context) (int, any, error) {
+		poolId, err := strconv.Atoi(c.Query("pool"))
+		if err != nil {
+			return 400, nil, errors.New("invalid pool index")
+		}
+		err = SwitchPool(c.Query("group"), poolId)
+		if err != nil {
+			return 400, nil, err
+		}
+		return 200, nil, nil
+	}))
+
+	admin.POST("/pause", adminHandler("pause", func(c *gin.Context) (int, any, error) {
+		PauseJobs(true)
+		return 200, nil, nil
+	}))
+	admin.POST("/resume", adminHandler("resume", func(c *gin.Context) (int, any, error) {
+		PauseJobs(false)
+		return 200, nil, nil
+	}))
+
+	admin.POST("/log", adminHandler("log_level", func(c *gin.Context) (int, any, error) {
+		level, ok := kilolog.ParseLevel(c.Query("level"))
+		if !ok {
+			return 400, nil, errors.New("invalid log level")
+		}
+		// until the next config reload
+		kilolog.SetLevel(c.Query("subsystem"), level)
+		return 200, nil, nil
+	}))
+
+	admin.POST("/reload", adminHandler("reload", func(c *gin.Context) (int, any, error) {
+		err := ReloadConfig()
+		if err != nil {
+			return 500, nil, err
+		}
+		return 200, nil, nil
+	}))
+}
@@ -0,0 +1,94 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"kiloproxy/config"
+	"strings"
+)
+
+var errUnsupportedAlgo = errors.New("unsupported algorithm")
+
+// Other names used by pools and miners for the same algorithms
+var algoAliases = map[string]string{
+	"randomx":     "rx/0",
+	"rx":          "rx/0",
+	"randomwow":   "rx/wow",
+	"randomarq":   "rx/arq",
+	"randomxl":    "rx/xla",
+	"cryptonight": "cn/0",
+}
+
+// detectedAlgos holds the algorithm of the jobs received from each pool, by pool url.
+// UpstreamsMut must be locked when reading or writing it.
+var detectedAlgos = make(map[string]string)
+
+func NormalizeAlgo(algo string) string {
+	algo = strings.ToLower(strings.TrimSpace(algo))
+	if v, ok := algoAliases[algo]; ok {
+		return v
+	}
+	return algo
+}
+
+// PoolAlgo returns the algorithm of the pool from the config, or detected from its jobs.
+// Returns an empty string if it is not known yet.
+// Note: UpstreamsMut must be locked before calling this
+func PoolAlgo(group string, poolId int) string {
+	pools := config.Get().GroupPools(group)
+	if poolId < 0 || poolId >= len(pools) {
+		return ""
+	}
+	if pools[poolId].Algo != "" {
+		return NormalizeAlgo(pools[poolId].Algo)
+	}
+	return detectedAlgos[pools[poolId].Url]
+}
+
+// SupportsAlgo returns true if the algorithm is in the miner's list. Miners that don't
+// send a list, and pools whose algorithm is not known yet, are assumed compatible.
+func SupportsAlgo(algos []string, algo string) bool {
+	if len(algos) == 0 || algo == "" {
+		return true
+	}
+	for _, v := range algos {
+		if NormalizeAlgo(v) == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// AlgoCounts returns the number of connected miners for each algorithm. The connection
+// locks are not taken, as they are held while a miner waits for a pool.
+func AlgoCounts() map[string]int {
+	UpstreamsMut.Lock()
+	defer UpstreamsMut.Unlock()
+	srv.ConnsMut.Lock()
+	defer srv.ConnsMut.Unlock()
+
+	counts := make(map[string]int)
+	for _, v := range srv.Connections {
+		if v.Algo != "" {
+			counts[v.Algo]++
+		}
+	}
+	return counts
+}
@@ -0,0 +1,85 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"kiloproxy/config"
+	"kiloproxy/kilolog"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type dashboardRole int
+
+const (
+	roleNone dashboardRole = iota
+	roleViewer
+	roleAdmin
+)
+
+// getRole returns the role given by the credentials of the request. The admin token gives
+// the admin role, the dashboard token or basic auth credentials give the viewer role.
+func getRole(c *gin.Context) dashboardRole {
+	cfg := config.Get().Dashboard
+	bearer, hasBearer := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+	if hasBearer && secretEqual(bearer, cfg.AdminToken) {
+		return roleAdmin
+	}
+	if !config.Get().DashboardAuth() {
+		return roleViewer
+	}
+	if hasBearer && secretEqual(bearer, cfg.Token) {
+		return roleViewer
+	}
+	if user, pass, ok := c.Request.BasicAuth(); ok && secretEqual(user, cfg.Username) && secretEqual(pass, cfg.Password) {
+		return roleViewer
+	}
+	return roleNone
+}
+
+// secretEqual compares the secrets in constant time. An empty expected secret never matches.
+func secretEqual(given, expected string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// dashboardAuth rejects the requests without valid credentials
+func dashboardAuth(c *gin.Context) {
+	if getRole(c) == roleNone {
+		kilolog.Debug("Unauthorized dashboard request from", c.RemoteIP())
+		if config.Get().Dashboard.Username != "" {
+			c.Header("WWW-Authenticate", `Basic realm="Kiloproxy"`)
+		}
+		c.AbortWithStatusJSON(401, gin.H{"error": "unauthorized"})
+		return
+	}
+	c.Next()
+}
+
+// adminAuth rejects the requests without the admin token
+func adminAuth(c *gin.Context) {
+	if getRole(c) != roleAdmin {
+		kilolog.Warn("Unauthorized admin request from", c.RemoteIP())
+		c.AbortWithStatusJSON(401, gin.H{"error": "unauthorized"})
+		return
+	}
+	c.Next()
+}
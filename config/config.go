@@ -23,3 +23,45 @@ const READ_TIMEOUT_SECONDS = 600
 const MAX_REQUEST_SIZE = 50000
 
 const HASHRATE_AVG_MINUTES = 30
+
+const HR_CHART_INTERVAL_MINUTES = 5
+const HR_CHART_SAMPLES = 288
+
+const STATS_SAVE_SECONDS = 60
+
+const POOL_FAILBACK_SECONDS = 60
+
+// consecutive successful probes of the primary pool before failing back to it
+const POOL_FAILBACK_PROBES = 3
+
+const MIGRATE_ATTEMPTS = 5
+const MIGRATE_RETRY_SECONDS = 10
+
+const RECENT_JOBS = 4
+
+const VARDIFF_MAX_CHANGE = 4
+const HASHRATE_MIN_SECONDS = 60
+
+const MAX_REJECT_REASONS = 20
+
+const SHUTDOWN_TIMEOUT_SECONDS = 15
+
+const SUBMIT_TIMEOUT_SECONDS = 30
+
+const CONFIG_WATCH_SECONDS = 5
+
+const DAEMON_POLL_SECONDS = 1
+const DAEMON_REFRESH_SECONDS = 30
+
+// the daemon is polled again with an exponential backoff after a failure, and given up
+// after DAEMON_MAX_FAILURES consecutive failures
+const DAEMON_MAX_FAILURES = 6
+const DAEMON_MAX_BACKOFF_SECONDS = 30
+
+const BAN_WINDOW_MINUTES = 10
+const LIMITS_CLEANUP_SECONDS = 60
+
+const PROXY_HEADER_TIMEOUT_SECONDS = 10
+
+const EVENTS_BUFFER = 256
+const EVENTS_KEEPALIVE_SECONDS = 15
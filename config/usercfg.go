@@ -19,38 +19,276 @@
 package config
 
 import (
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
 )
 
-var CFG Config
+var cfg atomic.Pointer[Config]
+
+func init() {
+	cfg.Store(&Config{})
+}
+
+// Get returns the active config. It must not be modified, a reload publishes a new one
+// with Set. Callers reading several settings should keep the returned pointer, so all of
+// them come from the same config.
+func Get() *Config {
+	return cfg.Load()
+}
+
+// Set publishes a validated config
+func Set(c *Config) {
+	cfg.Store(c)
+}
 
 type Config struct {
-	Pools []struct {
-		Url            string `json:"url"`
-		Tls            bool   `json:"tls"`
-		TlsFingerprint string `json:"fingerprint"`
-		User           string `json:"user"`
-		Pass           string `json:"pass"`
-	} `json:"pools"`
-	Bind []struct {
-		Host string `json:"host"`
-		Port uint16 `json:"port"`
-		Tls  bool   `json:"tls"`
-	} `json:"bind"`
-	Dashboard struct {
+	Pools      []Pool      `json:"pools"`
+	PoolGroups []PoolGroup `json:"pool_groups"`
+	Routes     []Route     `json:"routes"`
+	Bind       []Bind      `json:"bind"`
+	Dashboard  struct {
 		Enabled bool   `json:"enabled"`
 		Port    uint16 `json:"port"`
 		Host    string `json:"host"`
+		// Tls serves the dashboard over HTTPS, with cert_file and key_file, or with the
+		// certificate of the TLS binds if they're empty
+		Tls      bool   `json:"tls"`
+		CertFile string `json:"cert_file"`
+		KeyFile  string `json:"key_file"`
+		// Username and Password enable basic auth, Token enables bearer token auth. The
+		// dashboard is public if they're all empty.
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Token    string `json:"token"`
+		// AdminToken protects the admin API, which is disabled if it's empty
+		AdminToken string `json:"admin_token"`
+		Metrics    struct {
+			Enabled bool   `json:"enabled"`
+			Port    uint16 `json:"port"` // 0 means served by the dashboard
+			Host    string `json:"host"`
+		} `json:"metrics"`
 	} `json:"dashboard"`
-	PrintInterval  uint16 `json:"print_interval"`
-	Interactive    bool   `json:"interactive"`
-	MaxConcurrency int    `json:"max_concurrency"`
-	Colors         bool   `json:"colors"`
-	LogDate        bool   `json:"log_date"`
-	Title          bool   `json:"title"`
-	Verbose        bool   `json:"verbose"`
+	VarDiff struct {
+		Enabled      bool    `json:"enabled"`
+		StartDiff    uint64  `json:"start_diff"`
+		MinDiff      uint64  `json:"min_diff"`
+		MaxDiff      uint64  `json:"max_diff"`      // 0 means no limit other than the pool difficulty
+		TargetTime   float64 `json:"target_time"`   // seconds between shares
+		RetargetTime float64 `json:"retarget_time"` // seconds between retargets
+		Variance     float64 `json:"variance"`      // percent of target_time
+	} `json:"vardiff"`
+	Limits struct {
+		IpMaxConns           int `json:"ip_max_conns"`             // 0 means no limit
+		IpMaxLoginsPerMinute int `json:"ip_max_logins_per_minute"` // 0 means no limit
+		// BanThreshold is the number of malformed requests, invalid shares or refused logins
+		// in config.BAN_WINDOW_MINUTES before an IP is banned. 0 disables automatic bans.
+		BanThreshold int `json:"ban_threshold"`
+		BanMinutes   int `json:"ban_minutes"`
+	} `json:"limits"`
+	Log struct {
+		Format      string            `json:"format"` // "pretty" or "json"
+		Level       string            `json:"level"`  // empty means info, or debug if verbose
+		Levels      map[string]string `json:"levels"` // level of each subsystem
+		File        string            `json:"file"`   // empty means no log file
+		MaxSizeMB   int               `json:"max_size_mb"`
+		MaxAgeHours int               `json:"max_age_hours"`
+		MaxFiles    int               `json:"max_files"` // rotated files kept, 0 keeps all
+	} `json:"log"`
+	// SimpleAgents are patterns of miner agents that don't support nicehash mode
+	SimpleAgents   []string `json:"simple_agents"`
+	PrintInterval  uint16   `json:"print_interval"`
+	Interactive    bool     `json:"interactive"`
+	MaxConcurrency int      `json:"max_concurrency"`
+	Colors         bool     `json:"colors"`
+	LogDate        bool     `json:"log_date"`
+	Title          bool     `json:"title"`
+	Verbose        bool     `json:"verbose"`
+
+	simpleAgents []*regexp.Regexp
+}
+
+type Pool struct {
+	Url            string `json:"url"`
+	Tls            bool   `json:"tls"`
+	TlsFingerprint string `json:"fingerprint"`
+	User           string `json:"user"`
+	Pass           string `json:"pass"`
+	Algo           string `json:"algo"` // empty means detected from the pool's jobs
+	// Daemon is true if url is a monerod JSON-RPC address, for solo mining to the user address
+	Daemon bool `json:"daemon"`
+}
+
+// PoolGroup is a named failover chain of pools, used by the miners routed to it.
+// The top-level pools are the default group.
+type PoolGroup struct {
+	Name  string `json:"name"`
+	Pools []Pool `json:"pools"`
+}
+
+// Route sends the miners matching all of its patterns to a pool group.
+// Patterns are regular expressions, and an empty pattern matches everything.
+type Route struct {
+	Login string `json:"login"`
+	Pass  string `json:"pass"`
+	Agent string `json:"agent"`
+	Bind  uint16 `json:"bind"` // port of the bind, 0 matches every bind
+	Group string `json:"group"`
+
+	login, pass, agent *regexp.Regexp
+}
+
+// Match returns true if the miner matches the route. Validate must have been called.
+func (r *Route) Match(login, pass, agent string, port uint16) bool {
+	if r.Bind != 0 && r.Bind != port {
+		return false
+	}
+	return r.login.MatchString(login) && r.pass.MatchString(pass) && r.agent.MatchString(agent)
+}
+
+// GroupPools returns the pools of the named group. The empty name is the default group.
+func (c *Config) GroupPools(group string) []Pool {
+	if group == "" {
+		return c.Pools
+	}
+	for _, v := range c.PoolGroups {
+		if v.Name == group {
+			return v.Pools
+		}
+	}
+	return nil
+}
+
+// GroupNames returns the names of all the pool groups, including the default one
+func (c *Config) GroupNames() []string {
+	names := []string{""}
+	for _, v := range c.PoolGroups {
+		names = append(names, v.Name)
+	}
+	return names
+}
+
+type Bind struct {
+	Host string `json:"host"`
+	Port uint16 `json:"port"`
+	Tls  bool   `json:"tls"`
+	// ProxyProtocol requires a HAProxy PROXY protocol v1 or v2 header on every connection,
+	// to get the address of the miners behind a load balancer
+	ProxyProtocol bool `json:"proxy_protocol"`
+	// ProxyTrusted lists the CIDRs of the load balancers allowed to send a PROXY header,
+	// the other connections are refused. Required with ProxyProtocol.
+	ProxyTrusted []string `json:"proxy_trusted"`
+	// Simple gives every miner of this bind its own pool connection, for miners that
+	// don't support nicehash mode
+	Simple bool `json:"simple"`
+
+	// Access control, empty fields allow everyone.
+	// Password is checked against the miner's pass, Logins lists the allowed logins or
+	// worker names, Allow and Deny are lists of CIDRs checked against the miner's address.
+	Password string   `json:"password"`
+	Logins   []string `json:"logins"`
+	Allow    []string `json:"allow"`
+	Deny     []string `json:"deny"`
+
+	MaxConns           int `json:"max_conns"`             // 0 means no limit
+	MaxLoginsPerMinute int `json:"max_logins_per_minute"` // 0 means no limit
+
+	allow, deny, proxyTrusted []*net.IPNet
+}
+
+// FindBind returns the bind listening on the port, or nil
+func (c *Config) FindBind(port uint16) *Bind {
+	for i := range c.Bind {
+		if c.Bind[i].Port == port {
+			return &c.Bind[i]
+		}
+	}
+	return nil
+}
+
+// AllowsIP returns true if the address is not denied, and is allowed when there is an
+// allow list. Validate must have been called.
+func (b *Bind) AllowsIP(ip net.IP) bool {
+	for _, v := range b.deny {
+		if v.Contains(ip) {
+			return false
+		}
+	}
+	if len(b.allow) == 0 {
+		return true
+	}
+	for _, v := range b.allow {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustsProxy returns true if the address may send a PROXY header. An empty list trusts
+// nobody. Validate must have been called.
+func (b *Bind) TrustsProxy(ip net.IP) bool {
+	for _, v := range b.proxyTrusted {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsLogin returns true if the login, or its worker name after the last dot, is in
+// the logins list, or if the list is empty
+func (b *Bind) AllowsLogin(login string) bool {
+	if len(b.Logins) == 0 {
+		return true
+	}
+	worker := login[strings.LastIndex(login, ".")+1:]
+	for _, v := range b.Logins {
+		if v == login || v == worker {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsPassword returns true if the bind has no password or if pass matches it
+func (b *Bind) AllowsPassword(pass string) bool {
+	return b.Password == "" || subtle.ConstantTimeCompare([]byte(b.Password), []byte(pass)) == 1
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, v := range cidrs {
+		if !strings.Contains(v, "/") {
+			// a single address
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// IsSimpleAgent returns true if the agent matches one of the simple agents patterns.
+// Validate must have been called.
+func (c *Config) IsSimpleAgent(agent string) bool {
+	for _, v := range c.simpleAgents {
+		if v.MatchString(agent) {
+			return true
+		}
+	}
+	return false
 }
 
 const DefaultConfig = `{
@@ -68,23 +306,80 @@ const DefaultConfig = `{
 			"pass": "x"
 		}
 	],
+	"pool_groups": [],
+	"routes": [],
 	"bind": [
 		{
 			"host": "0.0.0.0",
 			"port": 3333,
-			"tls": false
+			"tls": false,
+			"proxy_protocol": false,
+			"proxy_trusted": [],
+			"simple": false,
+			"password": "",
+			"logins": [],
+			"allow": [],
+			"deny": [],
+			"max_conns": 0,
+			"max_logins_per_minute": 0
 		},
 		{
 			"host": "0.0.0.0",
 			"port": 3334,
-			"tls": true
+			"tls": true,
+			"proxy_protocol": false,
+			"proxy_trusted": [],
+			"simple": false,
+			"password": "",
+			"logins": [],
+			"allow": [],
+			"deny": [],
+			"max_conns": 0,
+			"max_logins_per_minute": 0
 		}
 	],
 	"dashboard": {
 		"enabled": false,
 		"port": 1315,
-		"host": "0.0.0.0"
+		"host": "0.0.0.0",
+		"tls": false,
+		"cert_file": "",
+		"key_file": "",
+		"username": "",
+		"password": "",
+		"token": "",
+		"admin_token": "",
+		"metrics": {
+			"enabled": false,
+			"port": 0,
+			"host": "0.0.0.0"
+		}
+	},
+	"vardiff": {
+		"enabled": true,
+		"start_diff": 10000,
+		"min_diff": 1000,
+		"max_diff": 0,
+		"target_time": 30,
+		"retarget_time": 120,
+		"variance": 30
+	},
+	"limits": {
+		"ip_max_conns": 100,
+		"ip_max_logins_per_minute": 60,
+		"ban_threshold": 50,
+		"ban_minutes": 60
 	},
+	"log": {
+		"format": "pretty",
+		"level": "",
+		"levels": {},
+		"file": "",
+		"max_size_mb": 100,
+		"max_age_hours": 24,
+		"max_files": 7
+	},
+	"simple_agents": [],
 	"print_interval": 60,
 	"interactive": true,
 	"max_concurrency": 4,
@@ -98,32 +393,136 @@ func (c *Config) Validate() error {
 	if len(c.Pools) == 0 {
 		return errors.New("no pools defined")
 	}
-	for _, v := range c.Pools {
-		if len(v.Url) == 0 {
-			return errors.New("invalid pool url")
+	err := validatePools(c.Pools)
+	if err != nil {
+		return err
+	}
+	groups := make(map[string]bool)
+	for _, v := range c.PoolGroups {
+		if v.Name == "" || groups[v.Name] {
+			return errors.New("pool group names must be unique and not empty")
 		}
-		if v.TlsFingerprint != "" {
-			if len(v.TlsFingerprint) != 64 {
-				return errors.New("invalid SHA-256 TLS fingerprint length")
-			}
-			_, err := hex.DecodeString(v.TlsFingerprint)
-			if err != nil {
-				return errors.New("invalid SHA-256 TLS fingerprint")
-			}
+		groups[v.Name] = true
+		if len(v.Pools) == 0 {
+			return errors.New("no pools defined in pool group " + v.Name)
+		}
+		err := validatePools(v.Pools)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range c.Routes {
+		r := &c.Routes[i]
+		if r.Group != "" && !groups[r.Group] {
+			return errors.New("unknown pool group in route: " + r.Group)
+		}
+		r.login, err = regexp.Compile(r.Login)
+		if err != nil {
+			return errors.New("invalid route login pattern: " + err.Error())
+		}
+		r.pass, err = regexp.Compile(r.Pass)
+		if err != nil {
+			return errors.New("invalid route pass pattern: " + err.Error())
 		}
+		r.agent, err = regexp.Compile(r.Agent)
+		if err != nil {
+			return errors.New("invalid route agent pattern: " + err.Error())
+		}
+	}
 
+	c.simpleAgents = make([]*regexp.Regexp, 0, len(c.SimpleAgents))
+	for _, v := range c.SimpleAgents {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return errors.New("invalid simple agent pattern: " + err.Error())
+		}
+		c.simpleAgents = append(c.simpleAgents, re)
 	}
 
 	if len(c.Bind) == 0 {
 		return errors.New("bind is empty")
 	}
-	for _, v := range c.Bind {
+	for i := range c.Bind {
+		v := &c.Bind[i]
 		if len(v.Host) == 0 || net.ParseIP(v.Host) == nil {
 			return errors.New("invalid bind host")
 		}
 		if v.Port == 0 {
 			return errors.New("invalid bind port")
 		}
+		if v.MaxConns < 0 || v.MaxLoginsPerMinute < 0 {
+			return errors.New("invalid bind limits")
+		}
+		v.allow, err = parseCIDRs(v.Allow)
+		if err != nil {
+			return errors.New("invalid bind allow list: " + err.Error())
+		}
+		v.deny, err = parseCIDRs(v.Deny)
+		if err != nil {
+			return errors.New("invalid bind deny list: " + err.Error())
+		}
+		v.proxyTrusted, err = parseCIDRs(v.ProxyTrusted)
+		if err != nil {
+			return errors.New("invalid bind trusted proxy list: " + err.Error())
+		}
+		if v.ProxyProtocol && len(v.proxyTrusted) == 0 {
+			// anyone could send a PROXY header and choose its own address
+			return errors.New("proxy_trusted is required with proxy_protocol")
+		}
+	}
+	if c.Dashboard.Metrics.Enabled && !c.MetricsOnDashboard() {
+		if c.Dashboard.Metrics.Port == 0 {
+			return errors.New("metrics port is required when the dashboard is disabled")
+		}
+		if net.ParseIP(c.Dashboard.Metrics.Host) == nil {
+			return errors.New("invalid metrics host")
+		}
+	}
+	if c.Dashboard.AdminToken != "" && len(c.Dashboard.AdminToken) < 16 {
+		return errors.New("admin token must be at least 16 characters long")
+	}
+	if (c.Dashboard.Username == "") != (c.Dashboard.Password == "") {
+		return errors.New("dashboard username and password must be set together")
+	}
+	if (c.Dashboard.CertFile == "") != (c.Dashboard.KeyFile == "") {
+		return errors.New("dashboard cert_file and key_file must be set together")
+	}
+	if !c.VarDiff.Enabled && c.hasDaemon() {
+		return errors.New("vardiff must be enabled for solo mining")
+	}
+	if c.VarDiff.Enabled {
+		if c.VarDiff.MinDiff == 0 {
+			return errors.New("invalid vardiff min diff")
+		}
+		if c.VarDiff.StartDiff < c.VarDiff.MinDiff {
+			return errors.New("vardiff start diff should not be lower than min diff")
+		}
+		if c.VarDiff.MaxDiff != 0 && c.VarDiff.MaxDiff < c.VarDiff.StartDiff {
+			return errors.New("vardiff max diff should not be lower than start diff")
+		}
+		if c.VarDiff.TargetTime <= 0 || c.VarDiff.RetargetTime < c.VarDiff.TargetTime {
+			return errors.New("invalid vardiff target time or retarget time")
+		}
+		if c.VarDiff.Variance < 0 || c.VarDiff.Variance >= 100 {
+			return errors.New("invalid vardiff variance (should be between 0 and 100)")
+		}
+	}
+	if c.Limits.IpMaxConns < 0 || c.Limits.IpMaxLoginsPerMinute < 0 || c.Limits.BanThreshold < 0 {
+		return errors.New("invalid limits")
+	}
+	if c.Limits.BanThreshold > 0 && c.Limits.BanMinutes <= 0 {
+		return errors.New("invalid ban minutes")
+	}
+	if c.Log.Format != "" && c.Log.Format != "pretty" && c.Log.Format != "json" {
+		return errors.New("invalid log format (should be pretty or json)")
+	}
+	for _, v := range append([]string{c.Log.Level}, mapValues(c.Log.Levels)...) {
+		if v != "" && v != "debug" && v != "info" && v != "warn" && v != "err" {
+			return errors.New("invalid log level " + v + " (should be debug, info, warn or err)")
+		}
+	}
+	if c.Log.MaxSizeMB < 0 || c.Log.MaxAgeHours < 0 || c.Log.MaxFiles < 0 {
+		return errors.New("invalid log rotation settings")
 	}
 	if c.PrintInterval == 0 {
 		return errors.New("invalid print interval")
@@ -133,3 +532,98 @@ func (c *Config) Validate() error {
 	}
 	return nil
 }
+
+// DashboardAuth returns true if the dashboard requires credentials
+func (c *Config) DashboardAuth() bool {
+	return c.Dashboard.Username != "" || c.Dashboard.Token != ""
+}
+
+const redacted = "REDACTED"
+
+// Redacted returns a copy of the config without the wallets, passwords and tokens
+func (c *Config) Redacted() Config {
+	r := *c
+	r.Pools = redactPools(c.Pools)
+	r.PoolGroups = make([]PoolGroup, len(c.PoolGroups))
+	for i, v := range c.PoolGroups {
+		r.PoolGroups[i] = PoolGroup{Name: v.Name, Pools: redactPools(v.Pools)}
+	}
+	r.Routes = append([]Route{}, c.Routes...)
+	for i := range r.Routes {
+		redact(&r.Routes[i].Pass)
+	}
+	r.Bind = append([]Bind{}, c.Bind...)
+	for i := range r.Bind {
+		redact(&r.Bind[i].Password)
+	}
+	redact(&r.Dashboard.Password)
+	redact(&r.Dashboard.Token)
+	redact(&r.Dashboard.AdminToken)
+	return r
+}
+
+func redactPools(pools []Pool) []Pool {
+	r := append([]Pool{}, pools...)
+	for i := range r {
+		redact(&r[i].User)
+		redact(&r[i].Pass)
+	}
+	return r
+}
+
+func redact(s *string) {
+	if *s != "" {
+		*s = redacted
+	}
+}
+
+// MetricsOnDashboard returns true if the metrics are served by the dashboard server
+// instead of their own server
+func (c *Config) MetricsOnDashboard() bool {
+	if !c.Dashboard.Enabled {
+		return false
+	}
+	m := c.Dashboard.Metrics
+	return m.Port == 0 || (m.Port == c.Dashboard.Port && m.Host == c.Dashboard.Host)
+}
+
+// hasDaemon returns true if any pool is a daemon
+func (c *Config) hasDaemon() bool {
+	for _, group := range c.GroupNames() {
+		for _, v := range c.GroupPools(group) {
+			if v.Daemon {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func mapValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+func validatePools(pools []Pool) error {
+	for _, v := range pools {
+		if len(v.Url) == 0 {
+			return errors.New("invalid pool url")
+		}
+		if v.Daemon && len(v.User) == 0 {
+			return errors.New("a wallet address is required as user for solo mining")
+		}
+		if v.TlsFingerprint != "" {
+			if len(v.TlsFingerprint) != 64 {
+				return errors.New("invalid SHA-256 TLS fingerprint length")
+			}
+			_, err := hex.DecodeString(v.TlsFingerprint)
+			if err != nil {
+				return errors.New("invalid SHA-256 TLS fingerprint")
+			}
+		}
+	}
+	return nil
+}
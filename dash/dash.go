@@ -6,3 +6,6 @@ import (
 
 //go:embed dash.html
 var MainPage []byte
+
+//go:embed miners.html
+var MinersPage []byte
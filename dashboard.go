@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"kiloproxy/config"
 	"kiloproxy/dash"
+	"kiloproxy/kilolog"
+	stratumserver "kiloproxy/stratum/server"
 	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -28,30 +37,125 @@ func timeSince(epoch int64) string {
 	}
 }
 
+var dashboardServer, metricsServer *http.Server
+
+// StartDashboard starts the dashboard and the metrics servers, if enabled
 func StartDashboard() {
+	cfg := config.Get()
+	if cfg.Dashboard.Enabled {
+		tlsConfig, err := dashboardTLSConfig()
+		if err != nil {
+			kilolog.Err("Failed to load the dashboard certificate:", err)
+		} else {
+			if !cfg.DashboardAuth() && !net.ParseIP(cfg.Dashboard.Host).IsLoopback() {
+				kilolog.Warn("The dashboard is public, set a username and password or a token to protect it")
+			}
+			dashboardServer = serveHTTP(fmt.Sprintf("%s:%d", cfg.Dashboard.Host, cfg.Dashboard.Port), dashboardRouter(), tlsConfig)
+			dashboardServer.RegisterOnShutdown(closeEventStreams)
+		}
+	}
+	if cfg.Dashboard.Metrics.Enabled && !cfg.MetricsOnDashboard() {
+		metricsServer = serveHTTP(fmt.Sprintf("%s:%d", cfg.Dashboard.Metrics.Host, cfg.Dashboard.Metrics.Port), metricsRouter(), nil)
+	}
+}
+
+// dashboardTLSConfig returns the TLS config of the dashboard, nil if it doesn't use HTTPS
+func dashboardTLSConfig() (*tls.Config, error) {
+	cfg := config.Get().Dashboard
+	if !cfg.Tls {
+		return nil, nil
+	}
+
+	var cert tls.Certificate
+	var err error
+	if cfg.CertFile != "" {
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	} else {
+		cert, err = stratumserver.LoadCertificate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// dashboardMut serializes the dashboard restarts
+var dashboardMut sync.Mutex
+
+// RestartDashboard restarts the dashboard and the metrics servers with the current config
+func RestartDashboard() {
+	dashboardMut.Lock()
+	defer dashboardMut.Unlock()
+
+	StopDashboard()
+	StartDashboard()
+}
+
+// StopDashboard stops the dashboard and the metrics servers
+func StopDashboard() {
+	for _, v := range []*http.Server{dashboardServer, metricsServer} {
+		if v == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		v.Shutdown(ctx)
+		cancel()
+	}
+	dashboardServer, metricsServer = nil, nil
+}
+
+// serveHTTP starts an HTTP server, using HTTPS if tlsConfig isn't nil
+func serveHTTP(addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			kilolog.Err("HTTP server failed:", err)
+		}
+	}()
+	return server
+}
+
+func dashboardRouter() *gin.Engine {
 	r := gin.Default()
+	r.Use(dashboardAuth)
 	r.GET("/", func(c *gin.Context) {
 		c.Data(200, "text/html", dash.MainPage)
 	})
 	r.GET("/stats", func(c *gin.Context) {
 		getStats()
 		c.JSON(200, gin.H{
-			"hr":        avgHashrate,
-			"miners":    numMiners,
-			"upstreams": numUpstreams,
+			"hr":               avgHashrate,
+			"miners":           numMiners,
+			"upstreams":        numUpstreams,
+			"shares_stale":     atomic.LoadUint64(&staleShares),
+			"shares_duplicate": atomic.LoadUint64(&duplicateShares),
+			"shares_invalid":   atomic.LoadUint64(&invalidShares),
+			"algos":            AlgoCounts(),
 		})
 	})
 	r.GET("/hr_chart", func(c *gin.Context) {
-		c.JSON(200, hrChart)
+		c.JSON(200, HrChart())
 	})
 	r.GET("/hr_chart_js", func(c *gin.Context) {
 		cd := chartData{
-			Labels: make([]string, 0, 288),
-			Data:   make([]float64, 0, 288),
-			Miners: make([]int, 0, 288),
+			Labels: make([]string, 0, config.HR_CHART_SAMPLES),
+			Data:   make([]float64, 0, config.HR_CHART_SAMPLES),
+			Miners: make([]int, 0, config.HR_CHART_SAMPLES),
 		}
 
-		for _, v := range hrChart {
+		for _, v := range HrChart() {
 			cd.Labels = append(cd.Labels, timeSince(v.Time))
 			cd.Data = append(cd.Data, math.Round(v.Hr/10)/100)
 			cd.Miners = append(cd.Miners, v.Miners)
@@ -59,9 +163,46 @@ func StartDashboard() {
 
 		c.JSON(200, cd)
 	})
+	r.GET("/miners.html", func(c *gin.Context) {
+		c.Data(200, "text/html", dash.MinersPage)
+	})
+	r.GET("/miners", func(c *gin.Context) {
+		f, err := parseMinerFilter(c.Query)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		miners, err := ListMiners(f)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, miners)
+	})
+	r.GET("/upstreams", func(c *gin.Context) {
+		c.JSON(200, ListUpstreams())
+	})
+	r.GET("/pools", func(c *gin.Context) {
+		c.JSON(200, ListPoolShares())
+	})
+	r.GET("/events", eventsHandler)
+	r.GET("/bans", func(c *gin.Context) {
+		c.JSON(200, Bans())
+	})
 	r.GET("/configuration", func(c *gin.Context) {
-		c.JSON(200, config.CFG)
+		cfg := config.Get()
+		if getRole(c) == roleAdmin {
+			c.JSON(200, cfg)
+			return
+		}
+		c.JSON(200, cfg.Redacted())
 	})
+	if cfg := config.Get(); cfg.Dashboard.Metrics.Enabled && cfg.MetricsOnDashboard() {
+		r.GET("/metrics", metricsHandler)
+	}
+	if config.Get().Dashboard.AdminToken != "" {
+		adminRouter(r)
+	}
 
-	r.Run(fmt.Sprintf("%s:%d", config.CFG.Dashboard.Host, config.CFG.Dashboard.Port))
+	return r
 }
@@ -0,0 +1,214 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"kiloproxy/config"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Event types
+const (
+	EventMinerConnected    = "miner_connected"
+	EventMinerDisconnected = "miner_disconnected"
+	EventMinerKicked       = "miner_kicked"
+	EventJob               = "job"
+	EventShare             = "share"
+	EventUpstreamConnected = "upstream_connected"
+	EventUpstreamLost      = "upstream_lost"
+	EventUpstreamClosed    = "upstream_closed"
+)
+
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// the miner ID is a string, as JavaScript can't represent all the uint64 values
+	Miner    uint64         `json:"miner,omitempty,string"`
+	Upstream uint64         `json:"upstream,omitempty"`
+	Data     map[string]any `json:"data,omitempty"`
+}
+
+type eventSubscriber struct {
+	events chan Event
+	done   chan struct{}
+
+	// filters, zero values match everything
+	miner    uint64
+	upstream uint64
+	types    map[string]bool
+
+	// number of events dropped because the subscriber was too slow, updated atomically
+	dropped uint64
+}
+
+func (s *eventSubscriber) matches(e *Event) bool {
+	return (s.miner == 0 || e.Miner == s.miner) &&
+		(s.upstream == 0 || e.Upstream == s.upstream) &&
+		(len(s.types) == 0 || s.types[e.Type])
+}
+
+// subscribersMut protects subscribers
+var subscribersMut sync.Mutex
+var subscribers = make(map[*eventSubscriber]bool)
+
+// number of subscribers, updated atomically, to skip building the events nobody listens to
+var numSubscribers int32
+
+// PublishEvent sends the event to the matching subscribers. Slow subscribers miss events
+// instead of blocking the proxy.
+func PublishEvent(e Event) {
+	if atomic.LoadInt32(&numSubscribers) == 0 {
+		return
+	}
+	e.Time = time.Now()
+
+	subscribersMut.Lock()
+	defer subscribersMut.Unlock()
+
+	for s := range subscribers {
+		if !s.matches(&e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// PublishShare publishes a share event. The result is accepted or rejected for the pool
+// verdict, valid for the shares only checked against the miner difficulty, or stale,
+// duplicate or invalid, with the reason of the rejection.
+func PublishShare(minerId, upstreamId uint64, jobId string, diff uint64, result, reason string) {
+	if atomic.LoadInt32(&numSubscribers) == 0 {
+		return
+	}
+
+	data := map[string]any{
+		"job_id": jobId,
+		"result": result,
+	}
+	if diff != 0 {
+		data["diff"] = diff
+	}
+	if reason != "" {
+		data["reason"] = reason
+	}
+	PublishEvent(Event{Type: EventShare, Miner: minerId, Upstream: upstreamId, Data: data})
+}
+
+func subscribe(s *eventSubscriber) {
+	subscribersMut.Lock()
+	defer subscribersMut.Unlock()
+
+	subscribers[s] = true
+	atomic.AddInt32(&numSubscribers, 1)
+}
+
+func unsubscribe(s *eventSubscriber) {
+	subscribersMut.Lock()
+	defer subscribersMut.Unlock()
+
+	if subscribers[s] {
+		delete(subscribers, s)
+		atomic.AddInt32(&numSubscribers, -1)
+	}
+}
+
+// closeEventStreams ends all the event streams, so the dashboard server can shut down
+func closeEventStreams() {
+	subscribersMut.Lock()
+	defer subscribersMut.Unlock()
+
+	for s := range subscribers {
+		close(s.done)
+		delete(subscribers, s)
+	}
+	atomic.StoreInt32(&numSubscribers, 0)
+}
+
+// eventsHandler streams the events as Server-Sent Events. The miner, upstream and type
+// query parameters filter the events, type is a comma-separated list.
+func eventsHandler(c *gin.Context) {
+	s := &eventSubscriber{
+		events: make(chan Event, config.EVENTS_BUFFER),
+		done:   make(chan struct{}),
+		types:  make(map[string]bool),
+	}
+	var err error
+	if v := c.Query("miner"); v != "" {
+		s.miner, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "invalid miner id"})
+			return
+		}
+	}
+	if v := c.Query("upstream"); v != "" {
+		s.upstream, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "invalid upstream id"})
+			return
+		}
+	}
+	if v := c.Query("type"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			s.types[t] = true
+		}
+	}
+
+	subscribe(s)
+	defer unsubscribe(s)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	keepalive := time.NewTicker(config.EVENTS_KEEPALIVE_SECONDS * time.Second)
+	defer keepalive.Stop()
+
+	// send the headers right away, so the client knows the stream is open
+	c.SSEvent("ready", gin.H{})
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-s.events:
+			if dropped := atomic.SwapUint64(&s.dropped, 0); dropped > 0 {
+				c.SSEvent("dropped", gin.H{"count": dropped})
+			}
+			c.SSEvent(e.Type, e)
+			return true
+		case <-keepalive.C:
+			// SSE comment, keeps the proxies from closing an idle stream
+			_, err := w.Write([]byte(": keepalive\n\n"))
+			return err == nil
+		case <-s.done:
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
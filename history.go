@@ -0,0 +1,164 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"kiloproxy/config"
+	"kiloproxy/kilolog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const statsFile = "./stats.json"
+
+// cumulative counters saved in the stats file, updated atomically
+var persistedCounters = map[string]*uint64{
+	"shares_accepted":            &acceptedShares,
+	"shares_rejected":            &rejectedShares,
+	"shares_stale":               &staleShares,
+	"shares_duplicate":           &duplicateShares,
+	"shares_invalid":             &invalidShares,
+	"miner_shares":               &minerShares,
+	"miner_difficulty_total":     &minerDiffTotal,
+	"submitted_difficulty_total": &submittedDiffTotal,
+}
+
+type statsSnapshot struct {
+	Time        time.Time         `json:"time"`
+	HrChart     []Hr              `json:"hr_chart"`
+	FoundShares []FoundShare      `json:"found_shares"`
+	Counters    map[string]uint64 `json:"counters"`
+}
+
+// saveStatsMut serializes the writes of the stats file, as PersistStats still runs during
+// the shutdown
+var saveStatsMut sync.Mutex
+
+// SaveStats writes the hashrate history and the counters to the stats file
+func SaveStats() error {
+	saveStatsMut.Lock()
+	defer saveStatsMut.Unlock()
+
+	snap := statsSnapshot{
+		Time:     time.Now(),
+		HrChart:  HrChart(),
+		Counters: make(map[string]uint64, len(persistedCounters)),
+	}
+	for k, v := range persistedCounters {
+		snap.Counters[k] = atomic.LoadUint64(v)
+	}
+
+	// shares found in the same minute are merged to keep the file small
+	foundSharesMut.Lock()
+	byMinute := make(map[int64]int)
+	for _, v := range foundShares {
+		if time.Since(v.Time) > config.HASHRATE_AVG_MINUTES*time.Minute {
+			continue
+		}
+		minute := v.Time.Unix() / 60
+		if i, ok := byMinute[minute]; ok {
+			snap.FoundShares[i].Diff += v.Diff
+			if v.Time.After(snap.FoundShares[i].Time) {
+				snap.FoundShares[i].Time = v.Time
+			}
+			continue
+		}
+		byMinute[minute] = len(snap.FoundShares)
+		snap.FoundShares = append(snap.FoundShares, v)
+	}
+	foundSharesMut.Unlock()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so a crash can't leave a truncated file
+	err = os.WriteFile(statsFile+".tmp", data, 0o666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(statsFile+".tmp", statsFile)
+}
+
+// LoadStats restores the hashrate history and the counters from the stats file, discarding
+// the samples older than the chart and average windows. A missing file is not an error.
+// Note: must be called before Stats and StartProxy
+func LoadStats() error {
+	data, err := os.ReadFile(statsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	snap := statsSnapshot{}
+	err = json.Unmarshal(data, &snap)
+	if err != nil {
+		return err
+	}
+
+	chartStart := time.Now().Add(-config.HR_CHART_SAMPLES * config.HR_CHART_INTERVAL_MINUTES * time.Minute).Unix()
+	chart := make([]Hr, 0, config.HR_CHART_SAMPLES)
+	for _, v := range snap.HrChart {
+		if v.Time > chartStart && v.Time <= time.Now().Unix() {
+			chart = append(chart, v)
+		}
+	}
+	if len(chart) > config.HR_CHART_SAMPLES {
+		chart = chart[len(chart)-config.HR_CHART_SAMPLES:]
+	}
+	hrChartMut.Lock()
+	hrChart = chart
+	hrChartMut.Unlock()
+
+	shares := make([]FoundShare, 0, len(snap.FoundShares))
+	for _, v := range snap.FoundShares {
+		if time.Since(v.Time) <= config.HASHRATE_AVG_MINUTES*time.Minute {
+			shares = append(shares, v)
+		}
+	}
+	foundSharesMut.Lock()
+	foundShares = shares
+	foundSharesMut.Unlock()
+
+	for k, v := range snap.Counters {
+		if c := persistedCounters[k]; c != nil {
+			atomic.StoreUint64(c, v)
+		}
+	}
+
+	kilolog.Info("Restored", len(chart), "hashrate samples from", snap.Time.Format(time.DateTime))
+	return nil
+}
+
+// PersistStats periodically saves the stats file
+func PersistStats() {
+	for {
+		time.Sleep(config.STATS_SAVE_SECONDS * time.Second)
+
+		err := SaveStats()
+		if err != nil {
+			kilolog.Err("Failed to save the stats:", err)
+		}
+	}
+}
@@ -24,108 +24,186 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
-var debug = " DEBUG "
-var info = " INFO  "
-var warn = " WARN  "
-var err = " ERR   "
-var fatal = " FATAL "
-var stats = " STATS "
-
-var COLOR_RESET = "\x1b[0m"
-
-var COLOR_BLACK = "\x1b[30m"
-var COLOR_RED = "\x1b[31m"
-var COLOR_GREEN = "\x1b[32m"
-var COLOR_YELLOW = "\x1b[33m"
-var COLOR_BLUE = "\x1b[34m"
-var COLOR_MAGENTA = "\x1b[35m"
-var COLOR_CYAN = "\x1b[36m"
-var COLOR_WHITE = "\x1b[37m"
-
-var BOLD = "\x1b[1m"
-var FAINT = "\x1b[2m"
-
-var COLOR_BG_BLACK = "\x1b[40m"
-var COLOR_BG_RED = "\x1b[41m"
-var COLOR_BG_GREEN = "\x1b[42m"
-var COLOR_BG_YELLOW = "\x1b[43m"
-var COLOR_BG_BLUE = "\x1b[44m"
-var COLOR_BG_MAGENTA = "\x1b[45m"
-var COLOR_BG_CYAN = "\x1b[36m"
-var COLOR_BG_WHITE = "\x1b[47m"
-
-func disableColors() {
-	COLOR_RESET = ""
-	COLOR_BLACK, COLOR_RED = "", ""
-	COLOR_GREEN, COLOR_YELLOW = "", ""
-	COLOR_BLUE, COLOR_MAGENTA = "", ""
-	COLOR_CYAN, COLOR_WHITE = "", ""
-
-	BOLD, FAINT = "", ""
-
-	COLOR_BG_BLACK, COLOR_BG_RED = "", ""
-	COLOR_BG_GREEN, COLOR_BG_YELLOW = "", ""
-	COLOR_BG_BLUE, COLOR_BG_MAGENTA = "", ""
-	COLOR_BG_CYAN, COLOR_BG_WHITE = "", ""
+// Colors holds the ANSI escape codes of the log output, empty when the colors are disabled
+type Colors struct {
+	Reset string
+
+	Black, Red, Green, Yellow, Blue, Magenta, Cyan, White string
+
+	Bold, Faint string
+
+	BgBlack, BgRed, BgGreen, BgYellow, BgBlue, BgMagenta, BgCyan, BgWhite string
 }
 
-func StartLogger() {
-	if config.CFG.Colors {
-		debug = COLOR_BG_MAGENTA + BOLD + debug + COLOR_RESET + FAINT + " "
-		info = COLOR_BG_BLUE + BOLD + info + COLOR_RESET + " "
-		warn = COLOR_BG_YELLOW + BOLD + warn + COLOR_RESET + " "
-		err = COLOR_BG_RED + BOLD + err + COLOR_RESET + " "
-		fatal = COLOR_BG_RED + BOLD + fatal + COLOR_RESET + " "
-		stats = COLOR_BG_GREEN + BOLD + stats + COLOR_RESET + " "
-	} else {
-		disableColors()
+type label int
+
+const (
+	labelDebug label = iota
+	labelInfo
+	labelWarn
+	labelErr
+	labelFatal
+	labelStats
+)
+
+// style holds the colors and the labels of the log output. It's never modified once
+// published, StartLogger publishes a new one.
+type style struct {
+	Colors
+	labels [labelStats + 1]string
+}
+
+var currentStyle atomic.Pointer[style]
+
+func init() {
+	currentStyle.Store(&style{Colors: ansiColors(), labels: plainLabels()})
+}
+
+// GetColors returns the colors of the log output
+func GetColors() Colors {
+	return currentStyle.Load().Colors
+}
+
+func ansiColors() Colors {
+	return Colors{
+		Reset: "\x1b[0m",
+
+		Black: "\x1b[30m", Red: "\x1b[31m",
+		Green: "\x1b[32m", Yellow: "\x1b[33m",
+		Blue: "\x1b[34m", Magenta: "\x1b[35m",
+		Cyan: "\x1b[36m", White: "\x1b[37m",
+
+		Bold: "\x1b[1m", Faint: "\x1b[2m",
+
+		BgBlack: "\x1b[40m", BgRed: "\x1b[41m",
+		BgGreen: "\x1b[42m", BgYellow: "\x1b[43m",
+		BgBlue: "\x1b[44m", BgMagenta: "\x1b[45m",
+		BgCyan: "\x1b[36m", BgWhite: "\x1b[47m",
 	}
 }
 
-func getCaller() string {
-	_, file, line, _ := runtime.Caller(2)
-	f := strings.Split(file, "/")
-	out := strings.Split(f[len(f)-1], ".")[0] + ":" + strconv.FormatInt(int64(line), 10)
-	for len(out) < 15 {
-		out = out + " "
+func plainLabels() [labelStats + 1]string {
+	return [...]string{
+		labelDebug: " DEBUG ",
+		labelInfo:  " INFO  ",
+		labelWarn:  " WARN  ",
+		labelErr:   " ERR   ",
+		labelFatal: " FATAL ",
+		labelStats: " STATS ",
 	}
-	return out
 }
 
-func getPrefix() (out string) {
-	if config.CFG.Verbose {
-		out = getCaller()
+// StartLogger applies the log settings of the config. It can be called again after
+// the config is reloaded.
+func StartLogger() {
+	cfg := config.Get()
+	loadLevels()
+
+	st := &style{labels: plainLabels()}
+	if cfg.Colors && cfg.Log.Format != "json" {
+		c := ansiColors()
+		st.Colors = c
+		st.labels[labelDebug] = c.BgMagenta + c.Bold + st.labels[labelDebug] + c.Reset + c.Faint + " "
+		st.labels[labelInfo] = c.BgBlue + c.Bold + st.labels[labelInfo] + c.Reset + " "
+		st.labels[labelWarn] = c.BgYellow + c.Bold + st.labels[labelWarn] + c.Reset + " "
+		st.labels[labelErr] = c.BgRed + c.Bold + st.labels[labelErr] + c.Reset + " "
+		st.labels[labelFatal] = c.BgRed + c.Bold + st.labels[labelFatal] + c.Reset + " "
+		st.labels[labelStats] = c.BgGreen + c.Bold + st.labels[labelStats] + c.Reset + " "
 	}
+	currentStyle.Store(st)
 
-	return
+	outMut.Lock()
+	defer outMut.Unlock()
+
+	jsonFormat = cfg.Log.Format == "json"
+
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+	if cfg.Log.File != "" {
+		f, e := openLogFile(cfg.Log.File)
+		if e != nil {
+			fmt.Println(" ERR   Failed to open the log file:", e)
+		} else {
+			logFile = f
+		}
+	}
 }
 
-func Debug(a ...any) {
-	if !config.CFG.Verbose {
-		return
+func getCaller(depth int) (file string, line int) {
+	_, path, line, _ := runtime.Caller(depth + 1)
+	f := strings.Split(path, "/")
+	return strings.Split(f[len(f)-1], ".")[0], line
+}
+
+func getPrefix(file string, line int) (out string) {
+	if config.Get().Verbose {
+		out = file + ":" + strconv.FormatInt(int64(line), 10)
+		for len(out) < 15 {
+			out = out + " "
+		}
 	}
 
-	fmt.Print(getPrefix() + debug + fmt.Sprintln(a...) + COLOR_RESET)
+	return
+}
+
+// Logger adds key/value fields, such as the miner, upstream or job ID, to its messages
+type Logger struct {
+	fields []any
+}
+
+// With returns a logger adding the given key/value pairs to its messages
+func With(kv ...any) *Logger {
+	return &Logger{fields: kv}
+}
+
+// With returns a logger adding the given key/value pairs to the ones of l
+func (l *Logger) With(kv ...any) *Logger {
+	fields := make([]any, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	return &Logger{fields: append(fields, kv...)}
+}
+
+func (l *Logger) Debug(a ...any) {
+	output(LevelDebug, labelDebug, l.fields, a...)
+}
+func (l *Logger) Info(a ...any) {
+	output(LevelInfo, labelInfo, l.fields, a...)
+}
+func (l *Logger) Warn(a ...any) {
+	output(LevelWarn, labelWarn, l.fields, a...)
+}
+func (l *Logger) Err(a ...any) {
+	output(LevelErr, labelErr, l.fields, a...)
+}
+
+func Debug(a ...any) {
+	output(LevelDebug, labelDebug, nil, a...)
 }
 func Info(a ...any) {
-	fmt.Print(getPrefix() + info + fmt.Sprintln(a...))
+	output(LevelInfo, labelInfo, nil, a...)
 }
 func Warn(a ...any) {
-	fmt.Print(getPrefix() + warn + fmt.Sprintln(a...))
+	output(LevelWarn, labelWarn, nil, a...)
 }
 func Err(a ...any) {
-	fmt.Print(getPrefix() + err + fmt.Sprintln(a...))
+	output(LevelErr, labelErr, nil, a...)
 }
 func Fatal(a ...any) {
-	fmt.Print(getPrefix() + fatal + fmt.Sprintln(a...))
+	output(LevelFatal, labelFatal, nil, a...)
 	panic(fmt.Sprintln(a...))
 }
 func Statsf(f string, a ...any) {
-	fmt.Print(getPrefix() + stats + fmt.Sprintf(f, a...) + "\n")
+	output(LevelInfo, labelStats, nil, fmt.Sprintf(f, a...))
 }
 
 func Printf(s string, a ...any) {
+	if jsonFormat {
+		return
+	}
 	fmt.Printf(s, a...)
 }
@@ -0,0 +1,297 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package kilolog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kiloproxy/config"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelErr
+	LevelFatal
+)
+
+var levelNames = []string{"debug", "info", "warn", "err", "fatal"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel converts a level name to a Level
+func ParseLevel(name string) (Level, bool) {
+	for i, v := range levelNames {
+		if v == name {
+			return Level(i), true
+		}
+	}
+	return LevelInfo, false
+}
+
+// outMut protects the outputs and the settings below
+var outMut sync.Mutex
+
+var jsonFormat bool
+var logFile *rotatingFile
+
+var ansiRegexp = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// logLevels holds the minimum levels logged, by subsystem. It's never modified once
+// published, SetLevel publishes a copy.
+type logLevels struct {
+	def        Level
+	subsystems map[string]Level
+}
+
+var levels atomic.Pointer[logLevels]
+
+// levelsMut serializes the changes of levels
+var levelsMut sync.Mutex
+
+func init() {
+	levels.Store(&logLevels{def: LevelInfo})
+}
+
+// loadLevels sets the levels from the config
+func loadLevels() {
+	cfg := config.Get()
+	l := &logLevels{def: LevelInfo, subsystems: make(map[string]Level, len(cfg.Log.Levels))}
+	if cfg.Log.Level != "" {
+		l.def, _ = ParseLevel(cfg.Log.Level)
+	} else if cfg.Verbose {
+		l.def = LevelDebug
+	}
+	for k, v := range cfg.Log.Levels {
+		l.subsystems[k], _ = ParseLevel(v)
+	}
+
+	levelsMut.Lock()
+	levels.Store(l)
+	levelsMut.Unlock()
+}
+
+// SetLevel changes the minimum level logged for the subsystem, or the default level if
+// subsystem is empty, until the logger is started again
+func SetLevel(subsystem string, level Level) {
+	levelsMut.Lock()
+	defer levelsMut.Unlock()
+
+	old := levels.Load()
+	l := &logLevels{def: old.def, subsystems: make(map[string]Level, len(old.subsystems)+1)}
+	for k, v := range old.subsystems {
+		l.subsystems[k] = v
+	}
+	if subsystem == "" {
+		l.def = level
+	} else {
+		l.subsystems[subsystem] = level
+	}
+	levels.Store(l)
+}
+
+// minLevel returns the minimum level logged for the subsystem. The subsystem is the
+// name of the source file, e.g. "upstream" or "client".
+func (l *logLevels) minLevel(subsystem string) Level {
+	if v, ok := l.subsystems[subsystem]; ok {
+		return v
+	}
+	return l.def
+}
+
+func output(level Level, lbl label, fields []any, a ...any) {
+	l := levels.Load()
+	if len(l.subsystems) == 0 && level < l.def {
+		// skip looking up the caller
+		return
+	}
+	subsystem, line := getCaller(2)
+	if level < l.minLevel(subsystem) {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintln(a...), "\n")
+
+	outMut.Lock()
+	defer outMut.Unlock()
+
+	var data []byte
+	if jsonFormat {
+		data = formatJSON(level, lbl, subsystem, fields, msg)
+	} else {
+		st := currentStyle.Load()
+		data = formatPretty(st.labels[lbl], st.Reset, subsystem, line, fields, msg)
+	}
+	os.Stdout.Write(data)
+
+	if logFile != nil {
+		if !jsonFormat {
+			data = ansiRegexp.ReplaceAll(data, nil)
+			data = append([]byte(time.Now().Format("2006-01-02 15:04:05 ")), data...)
+		}
+		_, e := logFile.Write(data)
+		if e != nil {
+			fmt.Println(" ERR   Failed to write to the log file:", e)
+		}
+	}
+}
+
+func formatPretty(label, reset, subsystem string, line int, fields []any, msg string) []byte {
+	buf := bytes.NewBufferString(getPrefix(subsystem, line) + label + msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(buf, " %v=%v", fields[i], fields[i+1])
+	}
+	buf.WriteString(reset + "\n")
+	return buf.Bytes()
+}
+
+func formatJSON(level Level, lbl label, subsystem string, fields []any, msg string) []byte {
+	levelName := level.String()
+	if lbl == labelStats {
+		levelName = "stats"
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, time.Now().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, levelName)
+	buf.WriteString(`,"subsystem":`)
+	writeJSONValue(buf, subsystem)
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		buf.WriteByte(',')
+		writeJSONValue(buf, fmt.Sprint(fields[i]))
+		buf.WriteByte(':')
+		writeJSONValue(buf, fields[i+1])
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSONValue(buf *bytes.Buffer, v any) {
+	if e, ok := v.(error); ok {
+		v = e.Error()
+	}
+	data, e := json.Marshal(v)
+	if e != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// rotatingFile is a log file rotated when it reaches the size or age limits of the config.
+// Rotated files are renamed with a timestamp suffix.
+type rotatingFile struct {
+	path   string
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openLogFile(path string) (*rotatingFile, error) {
+	r := &rotatingFile{path: path}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, e := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o666)
+	if e != nil {
+		return e
+	}
+	info, e := f.Stat()
+	if e != nil {
+		f.Close()
+		return e
+	}
+	r.f = f
+	r.size = info.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(data []byte) (int, error) {
+	cfg := config.Get().Log
+	if (cfg.MaxSizeMB > 0 && r.size+int64(len(data)) > int64(cfg.MaxSizeMB)*1024*1024) ||
+		(cfg.MaxAgeHours > 0 && time.Since(r.opened) > time.Duration(cfg.MaxAgeHours)*time.Hour) {
+		e := r.rotate()
+		if r.f == nil {
+			return 0, e
+		} else if e != nil {
+			fmt.Println(" ERR   Failed to rotate the log file:", e)
+		}
+	}
+
+	n, e := r.f.Write(data)
+	r.size += int64(n)
+	return n, e
+}
+
+// rotate renames the current file and opens a new one. If the file can't be renamed,
+// logging continues in the current file.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+
+	renameErr := os.Rename(r.path, r.path+"."+time.Now().Format("20060102-150405.000"))
+	if renameErr == nil {
+		r.prune()
+	}
+	e := r.open()
+	if e != nil {
+		return e
+	}
+	return renameErr
+}
+
+// prune removes the oldest rotated files, keeping Log.MaxFiles of them
+func (r *rotatingFile) prune() {
+	maxFiles := config.Get().Log.MaxFiles
+	if maxFiles <= 0 {
+		return
+	}
+	old, _ := filepath.Glob(r.path + ".*")
+	// the timestamp suffixes sort chronologically
+	sort.Strings(old)
+	for len(old) > maxFiles {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,331 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"kiloproxy/config"
+	"kiloproxy/kilolog"
+	stratumserver "kiloproxy/stratum/server"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const bansFile = "./bans.json"
+
+type Ban struct {
+	Expires time.Time `json:"expires"`
+	Reason  string    `json:"reason"`
+}
+
+// rateWindow counts events in fixed windows
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// add counts an event, and returns false if there were already limit events in the
+// current window. A limit of 0 means no limit.
+func (w *rateWindow) add(limit int, window time.Duration) bool {
+	if time.Since(w.start) >= window {
+		w.start = time.Now()
+		w.count = 0
+	}
+	w.count++
+	return limit == 0 || w.count <= limit
+}
+
+type ipState struct {
+	conns    int
+	logins   rateWindow
+	offenses rateWindow
+}
+
+// limitsMut protects the maps below
+var limitsMut sync.Mutex
+
+var ipStates = make(map[string]*ipState)
+var bindConns = make(map[uint16]int)
+var bindLogins = make(map[uint16]*rateWindow)
+var bans = make(map[string]Ban)
+
+// Note: limitsMut must be locked before calling this
+func getIpState(ip string) *ipState {
+	st := ipStates[ip]
+	if st == nil {
+		st = &ipState{}
+		ipStates[ip] = st
+	}
+	return st
+}
+
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Note: limitsMut must be locked before calling this
+func isBanned(ip string) bool {
+	ban, ok := bans[ip]
+	return ok && time.Now().Before(ban.Expires)
+}
+
+// AllowConnection refuses the connections from banned IPs, and the ones over the
+// concurrent connections limits of the IP or of the bind
+func AllowConnection(addr net.Addr, port uint16) bool {
+	ip := addrIP(addr)
+
+	limitsMut.Lock()
+	defer limitsMut.Unlock()
+
+	if isBanned(ip) {
+		return false
+	}
+
+	cfg := config.Get()
+	st := getIpState(ip)
+	if cfg.Limits.IpMaxConns != 0 && st.conns >= cfg.Limits.IpMaxConns {
+		kilolog.Debug("Too many connections from", ip)
+		return false
+	}
+	if bind := cfg.FindBind(port); bind != nil && bind.MaxConns != 0 && bindConns[port] >= bind.MaxConns {
+		kilolog.Debug("Too many connections on bind", port)
+		return false
+	}
+
+	st.conns++
+	bindConns[port]++
+	return true
+}
+
+// ReleaseConnection must be called when a connection allowed by AllowConnection is closed
+func ReleaseConnection(conn *stratumserver.Connection) {
+	limitsMut.Lock()
+	defer limitsMut.Unlock()
+
+	if st := ipStates[addrIP(conn.RemoteAddr)]; st != nil && st.conns > 0 {
+		st.conns--
+	}
+	if bindConns[conn.BindPort] > 0 {
+		bindConns[conn.BindPort]--
+	}
+}
+
+// AllowLogin returns false if the IP or the bind logged in too many times in the last minute
+func AllowLogin(conn *stratumserver.Connection) bool {
+	ip := addrIP(conn.RemoteAddr)
+
+	limitsMut.Lock()
+	defer limitsMut.Unlock()
+
+	cfg := config.Get()
+	allowed := getIpState(ip).logins.add(cfg.Limits.IpMaxLoginsPerMinute, time.Minute)
+
+	if bind := cfg.FindBind(conn.BindPort); bind != nil {
+		w := bindLogins[conn.BindPort]
+		if w == nil {
+			w = &rateWindow{}
+			bindLogins[conn.BindPort] = w
+		}
+		allowed = w.add(bind.MaxLoginsPerMinute, time.Minute) && allowed
+	}
+	return allowed
+}
+
+// Offense records abusive behavior from the connection's IP, and bans the IP when it
+// reaches the ban threshold.
+// Note: no lock must be held when calling this, as the IP's connections may be kicked
+func Offense(conn *stratumserver.Connection, reason string) {
+	limits := config.Get().Limits
+	threshold := limits.BanThreshold
+	if threshold == 0 {
+		return
+	}
+	ip := addrIP(conn.RemoteAddr)
+
+	limitsMut.Lock()
+	st := getIpState(ip)
+	st.offenses.add(0, config.BAN_WINDOW_MINUTES*time.Minute)
+	ban := st.offenses.count >= threshold
+	limitsMut.Unlock()
+
+	if ban {
+		BanIP(ip, time.Duration(limits.BanMinutes)*time.Minute, reason)
+	}
+}
+
+// BanIP bans the IP, and kicks its connections.
+// Note: no lock must be held when calling this
+func BanIP(ip string, duration time.Duration, reason string) {
+	kilolog.Warn("Banning", ip, "for", duration.String()+":", reason)
+
+	limitsMut.Lock()
+	bans[ip] = Ban{
+		Expires: time.Now().Add(duration),
+		Reason:  reason,
+	}
+	if st := ipStates[ip]; st != nil {
+		st.offenses = rateWindow{}
+	}
+	err := saveBans()
+	limitsMut.Unlock()
+	if err != nil {
+		kilolog.Err("Failed to save the ban list:", err)
+	}
+
+	for _, id := range ConnectionsByIP(ip) {
+		KickFor(id, "banned: "+reason)
+	}
+}
+
+// ConnectionsByIP returns the IDs of the connections from the IP
+func ConnectionsByIP(ip string) []uint64 {
+	srv.ConnsMut.Lock()
+	defer srv.ConnsMut.Unlock()
+
+	ids := make([]uint64, 0)
+	for _, v := range srv.Connections {
+		if addrIP(v.RemoteAddr) == ip {
+			ids = append(ids, v.Id)
+		}
+	}
+	return ids
+}
+
+// UnbanIP removes the IP from the ban list, returns false if it wasn't banned
+func UnbanIP(ip string) bool {
+	limitsMut.Lock()
+	defer limitsMut.Unlock()
+
+	if _, ok := bans[ip]; !ok {
+		return false
+	}
+	delete(bans, ip)
+	err := saveBans()
+	if err != nil {
+		kilolog.Err("Failed to save the ban list:", err)
+	}
+	kilolog.Info("Unbanned", ip)
+	return true
+}
+
+// Bans returns a copy of the ban list
+func Bans() map[string]Ban {
+	limitsMut.Lock()
+	defer limitsMut.Unlock()
+
+	list := make(map[string]Ban, len(bans))
+	for k, v := range bans {
+		list[k] = v
+	}
+	return list
+}
+
+// LoadBans reads the ban list from bans.json. A missing file is an empty list.
+func LoadBans() error {
+	data, err := os.ReadFile(bansFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	list := make(map[string]Ban)
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+
+	limitsMut.Lock()
+	bans = list
+	limitsMut.Unlock()
+	return nil
+}
+
+// Note: limitsMut must be locked before calling this
+func saveBans() error {
+	data, err := json.MarshalIndent(bans, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(bansFile, data, 0o666)
+	if err != nil {
+		return err
+	}
+	bansModTime = fileModTime(bansFile)
+	return nil
+}
+
+// modification time of bans.json when it was last read or written, protected by limitsMut
+var bansModTime time.Time
+
+// WatchLimits periodically removes the expired bans and the unused IP states, and reloads
+// bans.json when it is edited.
+func WatchLimits() {
+	limitsMut.Lock()
+	bansModTime = fileModTime(bansFile)
+	limitsMut.Unlock()
+
+	for {
+		time.Sleep(config.LIMITS_CLEANUP_SECONDS * time.Second)
+
+		limitsMut.Lock()
+		changed := !fileModTime(bansFile).Equal(bansModTime)
+		limitsMut.Unlock()
+
+		if changed {
+			kilolog.Info("Ban list changed, reloading it")
+			err := LoadBans()
+			if err != nil {
+				kilolog.Err("Failed to load the ban list:", err)
+			}
+			limitsMut.Lock()
+			bansModTime = fileModTime(bansFile)
+			limitsMut.Unlock()
+		}
+
+		limitsMut.Lock()
+		expired := false
+		for ip, ban := range bans {
+			if time.Now().After(ban.Expires) {
+				delete(bans, ip)
+				expired = true
+			}
+		}
+		if expired {
+			err := saveBans()
+			if err != nil {
+				kilolog.Err("Failed to save the ban list:", err)
+			}
+		}
+		for ip, st := range ipStates {
+			if st.conns == 0 && time.Since(st.logins.start) > time.Minute &&
+				time.Since(st.offenses.start) > config.BAN_WINDOW_MINUTES*time.Minute {
+				delete(ipStates, ip)
+			}
+		}
+		limitsMut.Unlock()
+	}
+}
@@ -33,39 +33,37 @@ import (
 )
 
 func main() {
-	err := loadConfig()
+	cfg, err := loadConfig()
 	if err != nil {
 		kilolog.Info(fmt.Sprintf("Failed to read config.json (%s), running configurator", err))
-		configurator()
+		cfg = configurator()
 	}
-	err = config.CFG.Validate()
+	err = cfg.Validate()
 	if err != nil {
 		kilolog.Fatal(err)
 	}
+	config.Set(cfg)
 
 	kilolog.StartLogger()
 
-	threads := runtime.GOMAXPROCS(0)
-	if threads > config.CFG.MaxConcurrency {
-		threads = config.CFG.MaxConcurrency
-		runtime.GOMAXPROCS(config.CFG.MaxConcurrency)
-	}
+	threads := SetConcurrency()
 
-	go StartDashboard()
+	StartDashboard()
 
-	if config.CFG.Title {
-		colCyan := kilolog.COLOR_CYAN
-		colGreen := kilolog.COLOR_GREEN
-		colWhite := kilolog.COLOR_WHITE
-		bold := kilolog.BOLD
+	if cfg.Title {
+		colors := kilolog.GetColors()
+		colCyan := colors.Cyan
+		colGreen := colors.Green
+		colWhite := colors.White
+		bold := colors.Bold
 
 		numThreads := strconv.FormatInt(int64(threads), 10)
-		threadsCol := kilolog.COLOR_GREEN
+		threadsCol := colors.Green
 
 		if numThreads == "2" {
-			threadsCol = kilolog.COLOR_YELLOW
+			threadsCol = colors.Yellow
 		} else if numThreads == "1" {
-			threadsCol = kilolog.COLOR_RED
+			threadsCol = colors.Red
 		}
 
 		hasCgo := "cgo"
@@ -78,47 +76,104 @@ func main() {
 		kilolog.Printf("%s * %s%s\n", bold+colGreen, colWhite,
 			"CREDITS      "+colCyan+"Developed by "+colWhite+"Kilopool.com"+colCyan+".")
 		kilolog.Printf("%s * %s%s\n", bold+colGreen, colWhite,
-			"PLATFORM     "+runtime.GOOS+"/"+runtime.GOARCH+" "+kilolog.COLOR_CYAN+hasCgo)
+			"PLATFORM     "+runtime.GOOS+"/"+runtime.GOARCH+" "+colCyan+hasCgo)
 		kilolog.Printf("%s * %s%s\n", bold+colGreen, colWhite,
 			"CONCURRENCY  "+threadsCol+numThreads+colWhite+" threads")
 
-		for i, v := range config.CFG.Pools {
+		for i, v := range cfg.Pools {
 			col := colCyan
 			if v.Tls {
 				col = colGreen
 			}
 
 			kilolog.Printf("%s * %s%s\n", bold+colGreen, colWhite,
-				fmt.Sprintf("POOL #%d      %s", i, col+v.Url+kilolog.COLOR_RESET))
+				fmt.Sprintf("POOL #%d      %s", i, col+v.Url+colors.Reset))
+		}
+		for _, g := range cfg.PoolGroups {
+			for i, v := range g.Pools {
+				col := colCyan
+				if v.Tls {
+					col = colGreen
+				}
+
+				kilolog.Printf("%s * %s%s\n", bold+colGreen, colWhite,
+					fmt.Sprintf("POOL %s#%d  %s", g.Name, i, col+v.Url+colors.Reset))
+			}
 		}
 
 	}
 
-	if config.CFG.Dashboard.Enabled {
-		kilolog.Info(fmt.Sprintf("Dashboard is available at http://127.0.0.1:%d", config.CFG.Dashboard.Port))
+	scheme := "http"
+	if cfg.Dashboard.Tls {
+		scheme = "https"
+	}
+	if cfg.Dashboard.Enabled {
+		kilolog.Info(fmt.Sprintf("Dashboard is available at %s://127.0.0.1:%d", scheme, cfg.Dashboard.Port))
+	}
+	if cfg.Dashboard.Metrics.Enabled {
+		port := cfg.Dashboard.Metrics.Port
+		if cfg.MetricsOnDashboard() {
+			port = cfg.Dashboard.Port
+		} else {
+			scheme = "http"
+		}
+		kilolog.Info(fmt.Sprintf("Metrics are available at %s://127.0.0.1:%d/metrics", scheme, port))
 	}
 
-	kilolog.Info("Using pool", config.CFG.Pools[0].Url)
+	kilolog.Info("Using pool", cfg.Pools[0].Url)
+
+	err = LoadBans()
+	if err != nil {
+		kilolog.Err("Failed to load the ban list:", err)
+	}
+
+	err = LoadStats()
+	if err != nil {
+		kilolog.Err("Failed to load the stats:", err)
+	}
 
 	go Stats()
+	go PersistStats()
+	go PoolFailback()
+	go WatchLimits()
 
 	StartProxy()
+
+	go WatchConfig()
+
+	os.Exit(WaitForShutdown())
 }
 
-func loadConfig() error {
-	data, err := os.ReadFile("./config.json")
+const configFile = "./config.json"
+
+func loadConfig() (*config.Config, error) {
+	data, err := os.ReadFile(configFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return json.Unmarshal(data, &config.CFG)
+	cfg := &config.Config{}
+	return cfg, json.Unmarshal(data, cfg)
+}
+
+var defaultThreads = runtime.GOMAXPROCS(0)
+
+// SetConcurrency limits the number of threads to the config's MaxConcurrency, and
+// returns the number of threads used
+func SetConcurrency() int {
+	threads := defaultThreads
+	if limit := config.Get().MaxConcurrency; threads > limit {
+		threads = limit
+	}
+	runtime.GOMAXPROCS(threads)
+	return threads
 }
 
 var wordRegexp = regexp.MustCompile("^\\w+$")
 var xmrRegexp = regexp.MustCompile("^[48][0-9AB][1-9A-HJ-NP-Za-km-z]{93}$")
 var zephRegexp = regexp.MustCompile("^ZEPH[1-9A-HJ-NP-Za-km-z]+$")
 
-func configurator() {
+func configurator() *config.Config {
 	userAddr := prompt("Enter your wallet address: ")
 	kilolog.Info(userAddr)
 
@@ -140,11 +195,13 @@ func configurator() {
 		curcfg = strings.ReplaceAll(curcfg, "PORT_NO_TLS", "3333")
 	}
 
-	os.WriteFile("./config.json", []byte(curcfg), 0o666)
-	err := json.Unmarshal([]byte(curcfg), &config.CFG)
+	os.WriteFile(configFile, []byte(curcfg), 0o666)
+	cfg := &config.Config{}
+	err := json.Unmarshal([]byte(curcfg), cfg)
 	if err != nil {
 		kilolog.Fatal(err)
 	}
+	return cfg
 }
 
 func prompt(lbl string) string {
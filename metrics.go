@@ -0,0 +1,249 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"kiloproxy/config"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Shares forwarded to the pool, by pool verdict, updated atomically
+var acceptedShares, rejectedShares uint64
+
+// Shares accepted at miner difficulty and difficulty totals, updated atomically
+var minerShares, minerDiffTotal, submittedDiffTotal uint64
+
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var jobBroadcastLatency = NewHistogram(latencyBuckets)
+var poolResponseLatency = NewHistogram(latencyBuckets)
+
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+
+	mut sync.Mutex
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe adds a sample to the histogram
+func (h *Histogram) Observe(v float64) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// ObserveSince adds the time elapsed since t, in seconds, to the histogram
+func (h *Histogram) ObserveSince(t time.Time) {
+	h.Observe(time.Since(t).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer, name, help string) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// WriteMetrics writes all the metrics in the Prometheus text exposition format
+func WriteMetrics(w io.Writer) {
+	srv.ConnsMut.Lock()
+	miners := len(srv.Connections)
+	srv.ConnsMut.Unlock()
+
+	type poolState struct {
+		group, url string
+		upstreams  int
+		active     int
+	}
+	pools := make([]poolState, 0)
+
+	UpstreamsMut.Lock()
+	upstreams := len(Upstreams)
+	cfg := config.Get()
+	for _, group := range cfg.GroupNames() {
+		first := len(pools)
+		for i, v := range cfg.GroupPools(group) {
+			active := 0
+			if i == CurrentPool[group] {
+				active = 1
+			}
+			pools = append(pools, poolState{group, v.Url, 0, active})
+		}
+		for _, us := range Upstreams {
+			if us.Group == group && us.Pool >= 0 && first+us.Pool < len(pools) {
+				pools[first+us.Pool].upstreams++
+			}
+		}
+	}
+	UpstreamsMut.Unlock()
+
+	writeMetric(w, "kiloproxy_miners", "gauge", "Number of connected miners.", miners)
+	writeMetric(w, "kiloproxy_upstreams", "gauge", "Number of pool connections.", upstreams)
+
+	fmt.Fprintf(w, "# HELP kiloproxy_miners_by_algo Number of connected miners, by algorithm.\n# TYPE kiloproxy_miners_by_algo gauge\n")
+	algos := AlgoCounts()
+	for _, algo := range sortedKeys(algos) {
+		fmt.Fprintf(w, "kiloproxy_miners_by_algo{algo=\"%s\"} %d\n", escapeLabel(algo), algos[algo])
+	}
+
+	fmt.Fprintf(w, "# HELP kiloproxy_pool_upstreams Number of connections to each pool.\n# TYPE kiloproxy_pool_upstreams gauge\n")
+	for _, v := range pools {
+		fmt.Fprintf(w, "kiloproxy_pool_upstreams{group=\"%s\",pool=\"%s\"} %d\n", escapeLabel(v.group), escapeLabel(v.url), v.upstreams)
+	}
+	fmt.Fprintf(w, "# HELP kiloproxy_pool_active Whether the pool is used for new upstreams of its group.\n# TYPE kiloproxy_pool_active gauge\n")
+	for _, v := range pools {
+		fmt.Fprintf(w, "kiloproxy_pool_active{group=\"%s\",pool=\"%s\"} %d\n", escapeLabel(v.group), escapeLabel(v.url), v.active)
+	}
+
+	poolShares := ListPoolShares()
+	fmt.Fprintf(w, "# HELP kiloproxy_pool_shares_total Shares forwarded to each pool, by verdict.\n# TYPE kiloproxy_pool_shares_total counter\n")
+	for _, v := range poolShares {
+		for _, s := range []struct {
+			verdict string
+			value   uint64
+		}{
+			{"accepted", v.Shares.Accepted},
+			{"rejected", v.Shares.Rejected},
+			{"stale", v.Shares.Stale},
+			{"invalid", v.Shares.Invalid},
+		} {
+			fmt.Fprintf(w, "kiloproxy_pool_shares_total{pool=\"%s\",verdict=\"%s\"} %d\n", escapeLabel(v.Url), s.verdict, s.value)
+		}
+	}
+	fmt.Fprintf(w, "# HELP kiloproxy_pool_difficulty_total Sum of the pool difficulty of the shares forwarded to each pool, by verdict.\n# TYPE kiloproxy_pool_difficulty_total counter\n")
+	for _, v := range poolShares {
+		for _, s := range []struct {
+			verdict string
+			value   uint64
+		}{
+			{"accepted", v.Shares.AcceptedDiff},
+			{"rejected", v.Shares.RejectedDiff},
+			{"stale", v.Shares.StaleDiff},
+			{"invalid", v.Shares.InvalidDiff},
+		} {
+			fmt.Fprintf(w, "kiloproxy_pool_difficulty_total{pool=\"%s\",verdict=\"%s\"} %d\n", escapeLabel(v.Url), s.verdict, s.value)
+		}
+	}
+	fmt.Fprintf(w, "# HELP kiloproxy_pool_rejections_total Shares of each pool that were not accepted, by reason.\n# TYPE kiloproxy_pool_rejections_total counter\n")
+	for _, v := range poolShares {
+		for _, reason := range sortedKeys(v.Shares.Reasons) {
+			fmt.Fprintf(w, "kiloproxy_pool_rejections_total{pool=\"%s\",reason=\"%s\"} %d\n", escapeLabel(v.Url), escapeLabel(reason), v.Shares.Reasons[reason])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP kiloproxy_shares_total Shares submitted by miners, by result.\n# TYPE kiloproxy_shares_total counter\n")
+	for _, v := range []struct {
+		result string
+		value  *uint64
+	}{
+		{"accepted", &acceptedShares},
+		{"rejected", &rejectedShares},
+		{"stale", &staleShares},
+		{"duplicate", &duplicateShares},
+		{"invalid", &invalidShares},
+	} {
+		fmt.Fprintf(w, "kiloproxy_shares_total{result=\"%s\"} %d\n", v.result, atomic.LoadUint64(v.value))
+	}
+
+	writeMetric(w, "kiloproxy_miner_shares_total", "counter", "Shares accepted at miner difficulty.", atomic.LoadUint64(&minerShares))
+	writeMetric(w, "kiloproxy_miner_difficulty_total", "counter", "Sum of the difficulty of shares accepted at miner difficulty.", atomic.LoadUint64(&minerDiffTotal))
+	writeMetric(w, "kiloproxy_submitted_difficulty_total", "counter", "Sum of the difficulty of shares submitted to the pool.", atomic.LoadUint64(&submittedDiffTotal))
+
+	jobBroadcastLatency.write(w, "kiloproxy_job_broadcast_seconds", "Time taken to send a new pool job to all the miners of an upstream.")
+	poolResponseLatency.write(w, "kiloproxy_pool_response_seconds", "Time taken by the pool to answer a share submission.")
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	writeMetric(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.", runtime.NumGoroutine())
+	writeMetric(w, "go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.", mem.Alloc)
+	writeMetric(w, "go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.", mem.Sys)
+	writeMetric(w, "go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.", mem.HeapInuse)
+	writeMetric(w, "go_memstats_heap_objects", "gauge", "Number of allocated objects.", mem.HeapObjects)
+	writeMetric(w, "go_gc_cycles_total", "counter", "Number of completed GC cycles.", mem.NumGC)
+	writeMetric(w, "go_gc_pause_seconds_total", "counter", "Total GC pause duration.", formatFloat(float64(mem.PauseTotalNs)/1e9))
+}
+
+func metricsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(200)
+	WriteMetrics(c.Writer)
+}
+
+// metricsRouter serves the metrics on their own address, used when they're not
+// served by the dashboard.
+func metricsRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.GET("/metrics", metricsHandler)
+	return r
+}
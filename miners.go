@@ -0,0 +1,186 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	stratumserver "kiloproxy/stratum/server"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type MinerInfo struct {
+	// the ID is a string, as JavaScript can't represent all the uint64 values
+	Id       uint64 `json:"id,string"`
+	Ip       string `json:"ip"`
+	Bind     uint16 `json:"bind"`
+	Tls      bool   `json:"tls"`
+	Login    string `json:"login"`
+	RigId    string `json:"rig_id"`
+	Agent    string `json:"agent"`
+	Algo     string `json:"algo"`
+	Group    string `json:"group"`
+	Upstream uint64 `json:"upstream"`
+	// Nicehash is the hex nicehash byte, empty for simple miners
+	Nicehash string `json:"nicehash"`
+	Diff     uint64 `json:"diff"`
+
+	// Connected and LastShare are unix timestamps, LastShare is 0 if the miner has no
+	// accepted share
+	Connected int64                     `json:"connected"`
+	LastShare int64                     `json:"last_share"`
+	Shares    stratumserver.ShareCounts `json:"shares"`
+	// Hashrate is estimated from the accepted shares
+	Hashrate float64 `json:"hashrate"`
+}
+
+// MinerFilter selects and orders the miners returned by ListMiners
+type MinerFilter struct {
+	// Search matches the IP, login, rig ID or agent, case insensitive
+	Search   string
+	Bind     uint16
+	Upstream uint64
+	// Idle selects the miners without valid shares for at least Idle
+	Idle time.Duration
+
+	Sort string
+	Desc bool
+}
+
+var errInvalidSort = errors.New("invalid sort field")
+
+var minerSorts = map[string]func(a, b *MinerInfo) bool{
+	"id":         func(a, b *MinerInfo) bool { return a.Id < b.Id },
+	"ip":         func(a, b *MinerInfo) bool { return a.Ip < b.Ip },
+	"bind":       func(a, b *MinerInfo) bool { return a.Bind < b.Bind },
+	"login":      func(a, b *MinerInfo) bool { return a.Login < b.Login },
+	"rig_id":     func(a, b *MinerInfo) bool { return a.RigId < b.RigId },
+	"agent":      func(a, b *MinerInfo) bool { return a.Agent < b.Agent },
+	"upstream":   func(a, b *MinerInfo) bool { return a.Upstream < b.Upstream },
+	"diff":       func(a, b *MinerInfo) bool { return a.Diff < b.Diff },
+	"connected":  func(a, b *MinerInfo) bool { return a.Connected < b.Connected },
+	"last_share": func(a, b *MinerInfo) bool { return a.LastShare < b.LastShare },
+	"shares":     func(a, b *MinerInfo) bool { return a.Shares.Accepted < b.Shares.Accepted },
+	"rejected":   func(a, b *MinerInfo) bool { return a.Shares.Rejected < b.Shares.Rejected },
+	"stale":      func(a, b *MinerInfo) bool { return a.Shares.Stale < b.Shares.Stale },
+	"invalid":    func(a, b *MinerInfo) bool { return a.Shares.Invalid < b.Shares.Invalid },
+	"hashrate":   func(a, b *MinerInfo) bool { return a.Hashrate < b.Hashrate },
+}
+
+// ListMiners returns the logged in miners matching the filter
+func ListMiners(f MinerFilter) ([]MinerInfo, error) {
+	if f.Sort == "" {
+		f.Sort = "connected"
+	}
+	less := minerSorts[f.Sort]
+	if less == nil {
+		return nil, errInvalidSort
+	}
+	search := strings.ToLower(f.Search)
+
+	UpstreamsMut.Lock()
+	srv.ConnsMut.Lock()
+	conns := append(srv.Connections[:0:0], srv.Connections...)
+	srv.ConnsMut.Unlock()
+
+	miners := make([]MinerInfo, 0, len(conns))
+	for _, conn := range conns {
+		// skip the miners that didn't finish logging in
+		if conn.Upstream == 0 {
+			continue
+		}
+
+		m := MinerInfo{
+			Id:        conn.Id,
+			Ip:        addrIP(conn.RemoteAddr),
+			Bind:      conn.BindPort,
+			Tls:       conn.Tls,
+			Login:     conn.Login,
+			RigId:     conn.RigId,
+			Agent:     conn.Agent,
+			Algo:      conn.Algo,
+			Group:     conn.Group,
+			Upstream:  conn.Upstream,
+			Diff:      conn.Diff,
+			Connected: conn.Connected.Unix(),
+			Shares:    conn.ShareStats.Counts(),
+			Hashrate:  conn.ShareStats.Hashrate(conn.Connected),
+		}
+		if !conn.Simple {
+			m.Nicehash = hex.EncodeToString([]byte{conn.Nicehash})
+		}
+		lastActive := conn.Connected
+		if !m.Shares.LastAccepted.IsZero() {
+			m.LastShare = m.Shares.LastAccepted.Unix()
+			lastActive = m.Shares.LastAccepted
+		}
+
+		if (f.Bind != 0 && m.Bind != f.Bind) || (f.Upstream != 0 && m.Upstream != f.Upstream) ||
+			(f.Idle != 0 && time.Since(lastActive) < f.Idle) {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(m.Ip+"\n"+m.Login+"\n"+m.RigId+"\n"+m.Agent), search) {
+			continue
+		}
+		miners = append(miners, m)
+	}
+	UpstreamsMut.Unlock()
+
+	sort.SliceStable(miners, func(i, j int) bool {
+		if f.Desc {
+			return less(&miners[j], &miners[i])
+		}
+		return less(&miners[i], &miners[j])
+	})
+	return miners, nil
+}
+
+// parseMinerFilter reads a MinerFilter from the query parameters of the miners endpoint
+func parseMinerFilter(query func(string) string) (MinerFilter, error) {
+	f := MinerFilter{
+		Search: query("search"),
+		Sort:   query("sort"),
+		Desc:   query("order") == "desc",
+	}
+	if v := query("bind"); v != "" {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return f, errors.New("invalid bind port")
+		}
+		f.Bind = uint16(port)
+	}
+	if v := query("upstream"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return f, errors.New("invalid upstream id")
+		}
+		f.Upstream = id
+	}
+	if v := query("idle"); v != "" {
+		seconds, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return f, errors.New("invalid idle seconds")
+		}
+		f.Idle = time.Duration(seconds) * time.Second
+	}
+	return f, nil
+}
@@ -0,0 +1,283 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"kiloproxy/config"
+	"kiloproxy/kilolog"
+	stratumclient "kiloproxy/stratum/client"
+	daemonclient "kiloproxy/stratum/daemon"
+	"kiloproxy/stratum/rpc"
+	"time"
+)
+
+// CurrentPool holds, for each pool group, the index of the pool used for new upstreams.
+// The default group has an empty name.
+// UpstreamsMut must be locked when reading or writing it.
+var CurrentPool = make(map[string]int)
+
+// pinnedPools holds the groups whose pool was switched by an admin. They don't fail back
+// to their primary pool until they fail over. Protected by UpstreamsMut
+var pinnedPools = make(map[string]bool)
+
+// PoolClient is a connection to a pool, or to a daemon for solo mining
+type PoolClient interface {
+	IsAlive() bool
+	// SubmitWork sends a share and returns the pool's response, with the miner's request
+	// ID. It's called concurrently by the miners of the upstream.
+	SubmitWork(nonce, jobid, result string, id uint64) (*rpc.Response, error)
+	// Fingerprint returns the fingerprint of the pool TLS certificate, empty if unknown
+	Fingerprint() string
+	Close()
+}
+
+// dialPool connects to the pool and waits for its first job. Returns the client, its
+// job channel, the first job and the client ID.
+func dialPool(pool config.Pool) (PoolClient, <-chan *rpc.CompleteJob, *rpc.CompleteJob, string, error) {
+	var client PoolClient
+	var clientId string
+	var jobChan <-chan *rpc.CompleteJob
+	var err error
+
+	if pool.Daemon {
+		dc := &daemonclient.Client{}
+		jobChan, err = dc.Connect(pool.Url, pool.Tls, pool.User)
+		client, clientId = dc, dc.ClientId
+	} else {
+		sc := &stratumclient.Client{}
+		jobChan, err = sc.Connect(
+			pool.Url,
+			pool.Tls,
+			pool.TlsFingerprint,
+			config.USERAGENT,
+			pool.User,
+			pool.Pass,
+		)
+		client, clientId = sc, sc.ClientId
+	}
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	recvJob := <-jobChan
+	if recvJob == nil {
+		client.Close()
+		return nil, nil, nil, "", errors.New("received nil job")
+	}
+
+	return client, jobChan, recvJob, clientId, nil
+}
+
+// PoolConn is a new pool connection, not used by an upstream yet
+type PoolConn struct {
+	Client   PoolClient
+	JobChan  <-chan *rpc.CompleteJob
+	Job      *rpc.CompleteJob
+	ClientId string
+	Pool     config.Pool
+}
+
+// ConnectPool connects to the current pool of the group, moving down the failover chain
+// until a pool accepts the login.
+// Note: UpstreamsMut must NOT be locked when calling this, the pools are dialed without it
+func ConnectPool(group string) (*PoolConn, error) {
+	UpstreamsMut.Lock()
+	pools := config.Get().GroupPools(group)
+	current := CurrentPool[group]
+	UpstreamsMut.Unlock()
+
+	if len(pools) == 0 {
+		return nil, errors.New("unknown pool group " + group)
+	}
+
+	for i := 0; i < len(pools); i++ {
+		poolId := (current + i) % len(pools)
+
+		client, jobChan, recvJob, clientId, err := dialPool(pools[poolId])
+		if err != nil {
+			kilolog.Warn("Pool", pools[poolId].Url, "failed:", err)
+			continue
+		}
+
+		if poolId != current {
+			UpstreamsMut.Lock()
+			// unless the chain moved meanwhile
+			if CurrentPool[group] == current {
+				kilolog.Warn("Switching to pool", pools[poolId].Url)
+				CurrentPool[group] = poolId
+			}
+			UpstreamsMut.Unlock()
+		}
+
+		return &PoolConn{
+			Client:   client,
+			JobChan:  jobChan,
+			Job:      recvJob,
+			ClientId: clientId,
+			Pool:     pools[poolId],
+		}, nil
+	}
+
+	return nil, errors.New("all pools are unreachable")
+}
+
+// PoolFailed moves the failover chain of the group to the next pool if poolId is the
+// current pool.
+// Note: UpstreamsMut must be locked before calling this
+func PoolFailed(group string, poolId int) {
+	pools := config.Get().GroupPools(group)
+	if poolId != CurrentPool[group] || len(pools) < 2 {
+		return
+	}
+
+	CurrentPool[group] = (poolId + 1) % len(pools)
+	delete(pinnedPools, group)
+
+	kilolog.Warn("Pool", pools[poolId].Url, "is down, switching to", pools[CurrentPool[group]].Url)
+}
+
+// PoolFailback periodically probes the primary pool of every group using a backup pool,
+// and switches back to it once it accepted POOL_FAILBACK_PROBES logins in a row. The
+// upstreams using a backup pool are then reconnected, so their miners move to it.
+func PoolFailback() {
+	// consecutive successful probes, by group
+	probes := make(map[string]int)
+
+	for {
+		time.Sleep(config.POOL_FAILBACK_SECONDS * time.Second)
+
+		UpstreamsMut.Lock()
+		backupGroups := make(map[string]int)
+		for group, poolId := range CurrentPool {
+			if poolId != 0 && !pinnedPools[group] {
+				backupGroups[group] = poolId
+			}
+		}
+		UpstreamsMut.Unlock()
+
+		for group := range probes {
+			if _, ok := backupGroups[group]; !ok {
+				delete(probes, group)
+			}
+		}
+
+		for group, poolId := range backupGroups {
+			pools := config.Get().GroupPools(group)
+			if len(pools) == 0 {
+				continue
+			}
+
+			kilolog.Debug("Probing primary pool", pools[0].Url)
+
+			client, jobChan, _, _, err := dialPool(pools[0])
+			if err != nil {
+				kilolog.Debug("Primary pool is still down:", err)
+				delete(probes, group)
+				continue
+			}
+			client.Close()
+			go func() {
+				for range jobChan {
+				}
+			}()
+
+			probes[group]++
+			if probes[group] < config.POOL_FAILBACK_PROBES {
+				kilolog.Debug("Primary pool is up,", probes[group], "probes of", config.POOL_FAILBACK_PROBES)
+				continue
+			}
+			delete(probes, group)
+
+			UpstreamsMut.Lock()
+			// unless the pool changed meanwhile
+			if CurrentPool[group] == poolId && !pinnedPools[group] {
+				CurrentPool[group] = 0
+				closeUpstreams(group, 0)
+				kilolog.Info("Primary pool is back online, switching to", pools[0].Url)
+			}
+			UpstreamsMut.Unlock()
+		}
+	}
+}
+
+// closeUpstreams closes the upstreams of the group using another pool than poolId. The
+// upstream handlers migrate their clients.
+// Note: UpstreamsMut must be locked before calling this
+func closeUpstreams(group string, poolId int) {
+	for _, us := range Upstreams {
+		if us.Group == group && us.Pool != poolId {
+			us.Close()
+		}
+	}
+}
+
+// RouteMiner returns the pool group for a miner, from the first matching route whose pool
+// uses an algorithm the miner supports. The default group is used when no route matches.
+func RouteMiner(login, pass, agent string, port uint16, algos []string) (string, error) {
+	UpstreamsMut.Lock()
+	defer UpstreamsMut.Unlock()
+
+	groups := make([]string, 0, 1)
+	for _, route := range config.Get().Routes {
+		if route.Match(login, pass, agent, port) {
+			groups = append(groups, route.Group)
+		}
+	}
+	groups = append(groups, "")
+
+	for i, group := range groups {
+		algo := PoolAlgo(group, CurrentPool[group])
+		if SupportsAlgo(algos, algo) {
+			if i != 0 {
+				kilolog.Debug("Miner rerouted to pool group", group, "for algorithm", algo)
+			}
+			return group, nil
+		}
+	}
+	return "", fmt.Errorf("%w, the pool uses %s", errUnsupportedAlgo, PoolAlgo(groups[0], CurrentPool[groups[0]]))
+}
+
+// SwitchPool makes the pool the current pool of the group, and reconnects the group's
+// upstreams using other pools, so their miners move to it
+func SwitchPool(group string, poolId int) error {
+	UpstreamsMut.Lock()
+	defer UpstreamsMut.Unlock()
+
+	pools := config.Get().GroupPools(group)
+	if len(pools) == 0 {
+		return errors.New("unknown pool group " + group)
+	}
+	if poolId < 0 || poolId >= len(pools) {
+		return errors.New("invalid pool index")
+	}
+
+	CurrentPool[group] = poolId
+	if poolId == 0 {
+		delete(pinnedPools, group)
+	} else {
+		pinnedPools[group] = true
+	}
+
+	closeUpstreams(group, poolId)
+
+	kilolog.Info("Switched to pool", pools[poolId].Url)
+	return nil
+}
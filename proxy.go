@@ -21,17 +21,25 @@ package main
 import (
 	"bufio"
 	"encoding/hex"
+	"errors"
 	"kiloproxy/config"
 	"kiloproxy/kilolog"
 	"kiloproxy/stratum/rpc"
 	stratumserver "kiloproxy/stratum/server"
 	"kiloproxy/stratum/template"
+	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
-var srv = stratumserver.Server{}
+var srv = stratumserver.Server{
+	NewConnections: make(chan *stratumserver.Connection, 1),
+}
 
 func StartProxy() {
+	srv.AllowConnection = AllowConnection
+
 	go func() {
 		for {
 			newConn := <-srv.NewConnections
@@ -39,14 +47,12 @@ func StartProxy() {
 		}
 	}()
 
-	for i, v := range config.CFG.Bind {
-		if i != len(config.CFG.Bind)-1 {
-			go srv.Start(v.Port, v.Host, v.Tls)
-		} else {
-			srv.Start(v.Port, v.Host, v.Tls)
+	for _, v := range config.Get().Bind {
+		err := srv.Start(v.Port, v.Host, v.Tls, v.ProxyProtocol)
+		if err != nil {
+			kilolog.Fatal(err)
 		}
 	}
-
 }
 
 func HandleConnection(conn *stratumserver.Connection) {
@@ -58,12 +64,33 @@ func HandleConnection(conn *stratumserver.Connection) {
 	if err != nil {
 		kilolog.Debug("ReadJSON failed in server:", err)
 		Kick(conn.Id)
+		if errors.Is(err, rpc.ErrMalformed) {
+			Offense(conn, "malformed request")
+		}
 		return
 	}
 	reqParams := req.Params
 	if reqParams.Agent == "" || reqParams.Login == "" || reqParams.Pass == "" {
 		kilolog.Debug("client sent a malformed login request")
+		SendError(conn, req.ID, "Malformed login request")
 		Kick(conn.Id)
+		Offense(conn, "malformed login request")
+		return
+	}
+
+	if !AllowLogin(conn) {
+		kilolog.Debug("Too many logins from", conn.RemoteAddr.String())
+		SendError(conn, req.ID, "Too many logins, try again later")
+		Kick(conn.Id)
+		Offense(conn, "login flood")
+		return
+	}
+
+	if reason := checkAccess(conn, reqParams.Login, reqParams.Pass); reason != "" {
+		kilolog.Info("Refusing miner", conn.RemoteAddr.String()+":", reason)
+		SendError(conn, req.ID, reason)
+		Kick(conn.Id)
+		Offense(conn, "refused login")
 		return
 	}
 
@@ -73,24 +100,57 @@ func HandleConnection(conn *stratumserver.Connection) {
 	kilolog.Debug("algo ", reqParams.Algo)
 	kilolog.Debug("agent", reqParams.Agent)
 
-	if reqParams.NicehashSupport {
+	if reqParams.NicehashSupport != nil && *reqParams.NicehashSupport {
 		kilolog.Debug("Client supports Nicehash mode (nicehash_support is true)")
 	}
+	simple := isSimpleMiner(conn.BindPort, reqParams.Agent, reqParams.NicehashSupport)
+	if simple {
+		kilolog.Debug("Client uses simple mode, it will get its own upstream")
+	}
+
+	group, err := RouteMiner(reqParams.Login, reqParams.Pass, reqParams.Agent, conn.BindPort, reqParams.Algo)
+	if err != nil {
+		kilolog.Info("Refusing miner", conn.RemoteAddr.String()+":", err)
+		SendError(conn, req.ID, err.Error())
+		Kick(conn.Id)
+		return
+	}
+
+	conn.Lock()
+	conn.Login = reqParams.Login
+	conn.Agent = reqParams.Agent
+	conn.RigId = reqParams.RigId
+	conn.Algos = reqParams.Algo
+	conn.Group = group
+	conn.Simple = simple
+	conn.Unlock()
+	if conn.Group != "" {
+		kilolog.Debug("Miner routed to pool group", conn.Group)
+	}
+
+	if ShuttingDown() {
+		Kick(conn.Id)
+		return
+	}
 
 	// Write login response
 
 	conn.Lock()
-	UpstreamsMut.Lock()
-	jobData, clientId, upstreamId, err := GetJob(conn)
-	UpstreamsMut.Unlock()
+	jobData, clientId, upstreamId, err := AssignJob(conn)
 	if err != nil {
 		kilolog.Warn(err)
+		if errors.Is(err, errUnsupportedAlgo) {
+			SendError(conn, req.ID, err.Error())
+		}
 		Kick(conn.Id)
 		conn.Unlock()
 		return
 	}
 
-	conn.Upstream = upstreamId
+	extensions := []string{"keepalive", "nicehash"}
+	if conn.Simple {
+		extensions = []string{"keepalive"}
+	}
 
 	loginResponse := stratumserver.LoginResponse{
 		ID:     req.ID,
@@ -106,13 +166,29 @@ func HandleConnection(conn *stratumserver.Connection) {
 				Target:   jobData.Target,
 			},
 			Status:     "OK",
-			Extensions: []string{"keepalive", "nicehash"},
+			Extensions: extensions,
 		},
 		Error: nil,
 	}
 	conn.Send(loginResponse)
+	conn.LoggedIn.Store(true)
 	conn.Unlock()
 
+	PublishEvent(Event{
+		Type:     EventMinerConnected,
+		Miner:    conn.Id,
+		Upstream: upstreamId,
+		Data: map[string]any{
+			"ip":     addrIP(conn.RemoteAddr),
+			"bind":   conn.BindPort,
+			"tls":    conn.Tls,
+			"login":  conn.Login,
+			"rig_id": conn.RigId,
+			"agent":  conn.Agent,
+			"algo":   NormalizeAlgo(jobData.Algo),
+		},
+	})
+
 	// Listen for submitted shares
 
 	for {
@@ -124,6 +200,9 @@ func HandleConnection(conn *stratumserver.Connection) {
 		if err != nil {
 			kilolog.Debug("conn.go ReadJSON failed in server:", err)
 			Kick(conn.Id)
+			if errors.Is(err, rpc.ErrMalformed) {
+				Offense(conn, "malformed request")
+			}
 			return
 		}
 
@@ -141,109 +220,264 @@ func HandleConnection(conn *stratumserver.Connection) {
 			continue
 		}
 
+		// the shutdown waits for the pending shares, don't add new ones
+		if ShuttingDown() {
+			SendError(conn, req.ID, "Proxy is shutting down")
+			continue
+		}
+
+		log := kilolog.With("miner", conn.Id, "upstream", conn.Upstream, "job", req.Params.JobID)
+
 		UpstreamsMut.Lock()
 		if Upstreams[conn.Upstream] == nil {
-			panic("Upstreams[conn.Upstream] is nil")
+			UpstreamsMut.Unlock()
+			log.Debug("Share submitted while upstream is reconnecting")
+			SendError(conn, req.ID, "Upstream is reconnecting")
+			continue
 		}
 
-		var diff uint64
-		if len(Upstreams[conn.Upstream].LastJob.Target) == 16 {
-			dec, err := hex.DecodeString(Upstreams[conn.Upstream].LastJob.Target)
-			if err != nil {
-				kilolog.Err(err)
-				Kick(conn.Id)
-				return
-			}
-			diff = template.MidDiffToDiff(dec)
-		} else {
-			dec, err := hex.DecodeString(Upstreams[conn.Upstream].LastJob.Target)
-			if err != nil {
-				kilolog.Err(err)
-				Kick(conn.Id)
-				return
-			}
-			diff = template.ShortDiffToDiff(dec)
+		us := Upstreams[conn.Upstream]
+		job := us.FindJob(req.Params.JobID)
+		issued, ok := IssuedJob{}, false
+		if job != nil {
+			issued, ok = job.Issued[conn.Id]
+		}
+		if !ok {
+			staleDiff := conn.Diff
+			UpstreamsMut.Unlock()
+			recordShare(conn, us, stratumserver.VerdictStale, staleDiff, "stale job")
+			PublishShare(conn.Id, conn.Upstream, req.Params.JobID, 0, "stale", "")
+			log.Debug("Stale share")
+			atomic.AddUint64(&staleShares, 1)
+			SendError(conn, req.ID, "Stale job")
+			continue
+		}
+
+		nonce := strings.ToLower(req.Params.Nonce)
+		nonceBin, err := hex.DecodeString(nonce)
+		if err != nil || len(nonceBin) != 4 || (!us.Simple && nonceBin[3] != issued.Nicehash) {
+			UpstreamsMut.Unlock()
+			recordShare(conn, us, stratumserver.VerdictInvalid, issued.Diff, "invalid nonce")
+			PublishShare(conn.Id, conn.Upstream, req.Params.JobID, issued.Diff, "invalid", "invalid nonce")
+			log.Debug("Miner sent an invalid nonce:", nonce)
+			atomic.AddUint64(&invalidShares, 1)
+			SendError(conn, req.ID, "Invalid nonce")
+			Offense(conn, "invalid share")
+			continue
+		}
+		if job.Nonces[nonce] {
+			UpstreamsMut.Unlock()
+			recordShare(conn, us, stratumserver.VerdictInvalid, issued.Diff, "duplicate share")
+			PublishShare(conn.Id, conn.Upstream, req.Params.JobID, issued.Diff, "duplicate", "")
+			log.Debug("Duplicate share, nonce", nonce)
+			atomic.AddUint64(&duplicateShares, 1)
+			SendError(conn, req.ID, "Duplicate share")
+			continue
+		}
+
+		poolDiff := job.Diff
+		minerDiff := issued.Diff
+
+		shareDiff, err := template.ResultToDiff(req.Params.Result)
+		if err != nil {
+			UpstreamsMut.Unlock()
+			recordShare(conn, us, stratumserver.VerdictInvalid, minerDiff, "malformed result")
+			PublishShare(conn.Id, conn.Upstream, req.Params.JobID, minerDiff, "invalid", "malformed result")
+			log.Debug("Miner sent a malformed result:", err)
+			atomic.AddUint64(&invalidShares, 1)
+			SendError(conn, req.ID, "Malformed share")
+			Offense(conn, "invalid share")
+			continue
+		}
+		if shareDiff < minerDiff {
+			UpstreamsMut.Unlock()
+			recordShare(conn, us, stratumserver.VerdictInvalid, minerDiff, "low difficulty")
+			PublishShare(conn.Id, conn.Upstream, req.Params.JobID, minerDiff, "invalid", "low difficulty")
+			log.Debug("Low difficulty share:", shareDiff, "target", minerDiff)
+			atomic.AddUint64(&invalidShares, 1)
+			SendError(conn, req.ID, "Low difficulty share")
+			Offense(conn, "invalid share")
+			continue
+		}
+		job.Nonces[nonce] = true
+		conn.Shares++
+
+		if shareDiff < poolDiff {
+			// the share is only good enough for the miner difficulty, the proxy accepts it
+			UpstreamsMut.Unlock()
+			recordShare(conn, us, stratumserver.VerdictAccepted, minerDiff, "")
+			PublishShare(conn.Id, conn.Upstream, req.Params.JobID, minerDiff, "valid", "")
+			conn.Send(stratumserver.Reply{
+				ID:      req.ID,
+				Jsonrpc: "2.0",
+				Result: map[string]any{
+					"status": "OK",
+				},
+			})
+			continue
 		}
 
-		foundShares = append(foundShares, FoundShare{
-			Time: time.Now(),
-			Diff: diff,
-		})
+		atomic.AddInt64(&pendingSubmits, 1)
+		if ShuttingDown() {
+			// the shutdown started after the check above, it may not see this share
+			atomic.AddInt64(&pendingSubmits, -1)
+			UpstreamsMut.Unlock()
+			SendError(conn, req.ID, "Proxy is shutting down")
+			continue
+		}
+		atomic.AddUint64(&submittedDiffTotal, poolDiff)
 
-		res, err := Upstreams[conn.Upstream].Stratum.SubmitWork(req.Params.Nonce, req.Params.JobID, req.Params.Result, req.ID)
+		client := us.Stratum
 		UpstreamsMut.Unlock()
+
+		// no lock is held while waiting for the pool, so the shares of other miners can be
+		// submitted meanwhile
+		submitTime := time.Now()
+		res, err := client.SubmitWork(req.Params.Nonce, req.Params.JobID, req.Params.Result, req.ID)
+		atomic.AddInt64(&pendingSubmits, -1)
+		if err == nil && res == nil {
+			err = errors.New("response is nil")
+		}
 		if err != nil {
-			kilolog.Err(err)
-			Kick(conn.Id)
-			return
-		} else if res == nil {
-			kilolog.Err("response is nil")
-			Kick(conn.Id)
-			return
+			// the miner stays connected, if the pool connection is lost the upstream
+			// handler migrates it to a new upstream
+			log.Warn("Failed to submit share:", err)
+			SendError(conn, req.ID, "Share not submitted: "+err.Error())
+			continue
 		}
+		poolResponseLatency.ObserveSince(submitTime)
 
-		kilolog.Debug("Sending SubmitWork response to client", res)
+		// the share counts towards the hashrate only once the pool accepted it
+		verdict, reason := poolVerdict(res)
+		recordShare(conn, us, verdict, minerDiff, reason)
+		us.PoolShares.Add(verdict, poolDiff, reason)
+		if verdict == stratumserver.VerdictAccepted {
+			atomic.AddUint64(&acceptedShares, 1)
+		} else {
+			atomic.AddUint64(&rejectedShares, 1)
+			log.Debug("Share rejected by the pool:", reason)
+		}
+		PublishShare(conn.Id, us.ID, req.Params.JobID, poolDiff, verdict.String(), reason)
+
+		log.Debug("Sending SubmitWork response to client", res)
 
 		conn.Send(res)
 	}
 }
 
-// Note: srv.ConnsMut must be locked before calling this
+// isSimpleMiner returns true if the miner can't use nicehash mode: it said so at login,
+// its bind is in simple mode, or its agent matches simple_agents
+func isSimpleMiner(port uint16, agent string, nicehashSupport *bool) bool {
+	if nicehashSupport != nil && !*nicehashSupport {
+		return true
+	}
+	cfg := config.Get()
+	if bind := cfg.FindBind(port); bind != nil && bind.Simple {
+		return true
+	}
+	return cfg.IsSimpleAgent(agent)
+}
+
+// checkAccess applies the access control of the miner's bind. Returns the reason the
+// miner is refused, or an empty string if it is allowed.
+func checkAccess(conn *stratumserver.Connection, login, pass string) string {
+	bind := config.Get().FindBind(conn.BindPort)
+	if bind == nil {
+		// the bind was removed from the config
+		return "Access denied"
+	}
+
+	if !bind.AllowsIP(net.ParseIP(addrIP(conn.RemoteAddr))) {
+		return "Address not allowed"
+	}
+	if !bind.AllowsPassword(pass) {
+		return "Invalid password"
+	}
+	if !bind.AllowsLogin(login) {
+		return "Login not allowed"
+	}
+	return ""
+}
+
+// SendError replies to the request with a stratum error
+func SendError(conn *stratumserver.Connection, id uint64, message string) error {
+	return conn.Send(stratumserver.Reply{
+		ID:      id,
+		Jsonrpc: "2.0",
+		Error: &stratumserver.ErrorJson{
+			Code:    -1,
+			Message: message,
+		},
+	})
+}
+
+// Kick closes the connection and removes it from the server and from its upstream.
+// Note: srv.ConnsMut and UpstreamsMut must NOT be locked when calling this
 func Kick(id uint64) {
+	var conn *stratumserver.Connection
+
+	srv.ConnsMut.Lock()
 	for i, v := range srv.Connections {
 		if v.Id == id {
-			// Close the connection
-			v.Conn.Close()
-
-			if Upstreams[v.Upstream] != nil {
-				// remove client from upstream
-				UpstreamsMut.Lock()
-				for clid, clval := range Upstreams[v.Upstream].Clients {
-					if clval == v.Id {
-						Upstreams[v.Upstream].Clients[clid] = Upstreams[v.Upstream].Clients[len(Upstreams[v.Upstream].Clients)-1]
-						Upstreams[v.Upstream].Clients = Upstreams[v.Upstream].Clients[:len(Upstreams[v.Upstream].Clients)-1]
-					}
-				}
-				// If upstream is empty, close it
-				if len(Upstreams[v.Upstream].Clients) == 0 {
-					Upstreams[v.Upstream].Close()
-				}
-				UpstreamsMut.Unlock()
-			}
-
+			conn = v
 			// remove client from server connections
-			if len(srv.Connections) > 1 {
-				srv.Connections = append(srv.Connections[:i], srv.Connections[i+1:]...)
-			} else {
-				srv.Connections = make([]*stratumserver.Connection, 0, 100)
-			}
+			srv.Connections = append(srv.Connections[:i], srv.Connections[i+1:]...)
+			break
 		}
 	}
+	srv.ConnsMut.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	// Close the connection
+	conn.Conn.Close()
+	ReleaseConnection(conn)
+
+	UpstreamsMut.Lock()
+	upstreamId := conn.Upstream
+	RemoveClient(conn.Upstream, id)
+	UpstreamsMut.Unlock()
+
+	if conn.LoggedIn.Load() {
+		PublishEvent(Event{Type: EventMinerDisconnected, Miner: id, Upstream: upstreamId})
+	}
+}
+
+// KickFor kicks the miner, and publishes the reason if it was logged in.
+// Note: srv.ConnsMut and UpstreamsMut must NOT be locked when calling this
+func KickFor(id uint64, reason string) {
+	if conn := FindConnection(id); conn != nil && conn.LoggedIn.Load() {
+		PublishEvent(Event{Type: EventMinerKicked, Miner: id, Data: map[string]any{"reason": reason}})
+	}
+	Kick(id)
 }
 
-func GetNewJob(conn *stratumserver.Connection, job rpc.CompleteJob) {
+// GetNewJob sends a new job to the connection. If an error is returned, the caller
+// should kick the connection.
+// Note: UpstreamsMut must be locked before calling this
+func GetNewJob(conn *stratumserver.Connection) error {
 	conn.Lock()
 	defer conn.Unlock()
 
-	jobData, _, upstreamId, err := GetJob(conn)
+	jobData, _, _, err := GetJob(conn)
 	if err != nil {
-		kilolog.Warn(err)
-		Kick(conn.Id)
-		return
-	}
-	if conn.Upstream != upstreamId {
-		kilolog.Debug("Upstream changed:", conn.Upstream)
-		conn.Upstream = upstreamId
+		return err
 	}
+	sendJob(conn, jobData)
+	return nil
+}
 
-	jobContent := rpc.JobRpc{
+// sendJob sends the job to the connection. A failed send is only logged, the miner's
+// read loop notices the broken connection.
+func sendJob(conn *stratumserver.Connection, jobData rpc.CompleteJob) {
+	err := conn.Send(rpc.JobRpc{
 		Jsonrpc: "2.0",
 		Method:  "job",
 
 		Params: jobData,
-	}
-
-	err = conn.Send(jobContent)
+	})
 	if err != nil {
 		kilolog.Err(err)
 	}
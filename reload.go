@@ -0,0 +1,205 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kiloproxy/config"
+	"kiloproxy/kilolog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WatchConfig reloads the config when SIGHUP is received or when config.json is modified
+func WatchConfig() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	lastMod := fileModTime(configFile)
+
+	for {
+		select {
+		case <-sigs:
+			kilolog.Info("Received SIGHUP, reloading config")
+		case <-time.After(config.CONFIG_WATCH_SECONDS * time.Second):
+			mod := fileModTime(configFile)
+			if mod.Equal(lastMod) {
+				continue
+			}
+			kilolog.Info("Config file changed, reloading config")
+		}
+		lastMod = fileModTime(configFile)
+
+		err := ReloadConfig()
+		if err != nil {
+			kilolog.Err("Config reload failed, keeping the old config:", err)
+		}
+	}
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadMut serializes the config reloads
+var reloadMut sync.Mutex
+
+// ReloadConfig reads config.json again and applies the changes that can be applied
+// without restarting. If the new config is invalid, the old one stays active.
+func ReloadConfig() error {
+	reloadMut.Lock()
+	defer reloadMut.Unlock()
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	newCfg := config.Config{}
+	err = json.Unmarshal(data, &newCfg)
+	if err != nil {
+		return err
+	}
+	err = newCfg.Validate()
+	if err != nil {
+		return err
+	}
+
+	oldCfg := config.Get()
+	changed := changedFields(oldCfg, &newCfg)
+	if len(changed) == 0 {
+		kilolog.Info("Config is unchanged")
+		return nil
+	}
+
+	UpstreamsMut.Lock()
+	config.Set(&newCfg)
+	remapPools(oldCfg)
+	UpstreamsMut.Unlock()
+
+	restart := make([]string, 0)
+	for _, v := range changed {
+		switch v {
+		case "pools", "pool_groups":
+			kilolog.Info("Pools changed, they will be used by new upstreams")
+		case "bind":
+			reloadBinds(oldCfg.Bind, newCfg.Bind)
+		case "dashboard":
+			// in the background, as the reload may come from a dashboard request
+			go RestartDashboard()
+		case "colors", "log", "verbose":
+			kilolog.StartLogger()
+		case "max_concurrency":
+			kilolog.Info("Using", SetConcurrency(), "threads")
+		case "routes", "vardiff", "limits", "simple_agents", "print_interval", "log_date", "title", "interactive":
+			// these settings are read every time they're used
+		default:
+			restart = append(restart, v)
+		}
+	}
+
+	kilolog.Info("Config reloaded, changed:", strings.Join(changed, ", "))
+	if len(restart) > 0 {
+		kilolog.Warn("These changes require a restart:", strings.Join(restart, ", "))
+	}
+	return nil
+}
+
+// changedFields returns the JSON names of the top-level config fields that differ
+func changedFields(a, b *config.Config) []string {
+	changed := make([]string, 0)
+
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		if !va.Type().Field(i).IsExported() {
+			continue
+		}
+		// compare the JSON encoding, as it ignores unexported fields
+		ja, _ := json.Marshal(va.Field(i).Interface())
+		jb, _ := json.Marshal(vb.Field(i).Interface())
+		if !bytes.Equal(ja, jb) {
+			name := strings.Split(va.Type().Field(i).Tag.Get("json"), ",")[0]
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// remapPools updates the pool index of the existing upstreams after the pools changed,
+// and resets the failover chains of the groups that changed. Upstreams on a pool that
+// was removed keep running, but are not reused.
+// Note: UpstreamsMut must be locked before calling this
+func remapPools(oldCfg *config.Config) {
+	for _, us := range Upstreams {
+		oldPools := oldCfg.GroupPools(us.Group)
+		if us.Pool < 0 || us.Pool >= len(oldPools) {
+			continue
+		}
+		url := oldPools[us.Pool].Url
+		us.Pool = -1
+		for i, v := range config.Get().GroupPools(us.Group) {
+			if v.Url == url {
+				us.Pool = i
+				break
+			}
+		}
+	}
+	for group := range CurrentPool {
+		if !reflect.DeepEqual(oldCfg.GroupPools(group), config.Get().GroupPools(group)) {
+			delete(CurrentPool, group)
+		}
+	}
+}
+
+func reloadBinds(oldBinds, newBinds []config.Bind) {
+	for _, v := range oldBinds {
+		if !containsBind(newBinds, v) {
+			srv.StopListener(v.Port, v.Host)
+		}
+	}
+	for _, v := range newBinds {
+		if !containsBind(oldBinds, v) {
+			err := srv.Start(v.Port, v.Host, v.Tls, v.ProxyProtocol)
+			if err != nil {
+				kilolog.Err(fmt.Sprintf("Failed to listen on %s:%d: %s", v.Host, v.Port, err))
+			}
+		}
+	}
+}
+
+// containsBind returns true if a bind listens on the same address with the same
+// protocol. The other bind settings are read for every new miner.
+func containsBind(binds []config.Bind, bind config.Bind) bool {
+	for _, v := range binds {
+		if v.Host == bind.Host && v.Port == bind.Port && v.Tls == bind.Tls && v.ProxyProtocol == bind.ProxyProtocol {
+			return true
+		}
+	}
+	return false
+}
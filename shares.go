@@ -0,0 +1,149 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kiloproxy/stratum/rpc"
+	stratumserver "kiloproxy/stratum/server"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// poolShares holds the share stats of each pool, by pool url.
+// UpstreamsMut must be locked when reading or writing it.
+var poolShares = make(map[string]*stratumserver.ShareStats)
+
+// PoolShares returns the share stats of the pool, creating them if needed
+// Note: UpstreamsMut must be locked before calling this
+func PoolShares(url string) *stratumserver.ShareStats {
+	s := poolShares[url]
+	if s == nil {
+		s = &stratumserver.ShareStats{}
+		poolShares[url] = s
+	}
+	return s
+}
+
+// recordShare counts a share of the miner in its stats and the stats of its upstream, at
+// miner difficulty. Only the accepted shares count towards the hashrate. us is nil if the
+// upstream is not known.
+func recordShare(conn *stratumserver.Connection, us *Upstream, v stratumserver.Verdict, diff uint64, reason string) {
+	conn.ShareStats.Add(v, diff, reason)
+	if us != nil {
+		us.Shares.Add(v, diff, reason)
+	}
+	if v != stratumserver.VerdictAccepted {
+		return
+	}
+
+	atomic.AddUint64(&minerShares, 1)
+	atomic.AddUint64(&minerDiffTotal, diff)
+
+	foundSharesMut.Lock()
+	foundShares = append(foundShares, FoundShare{
+		Time: time.Now(),
+		Diff: diff,
+	})
+	foundSharesMut.Unlock()
+}
+
+// poolVerdict reads the pool's answer to a share submission. Returns the verdict, and
+// the pool's reason if the share was not accepted.
+func poolVerdict(res *rpc.Response) (stratumserver.Verdict, string) {
+	if res.Error != nil {
+		reason := poolErrorMessage(res.Error)
+		if isStaleReason(reason) {
+			return stratumserver.VerdictStale, reason
+		}
+		return stratumserver.VerdictRejected, reason
+	}
+
+	// some pools answer with a status other than OK instead of an error
+	if res.Result != nil {
+		result := struct {
+			Status string `json:"status"`
+		}{}
+		if json.Unmarshal(*res.Result, &result) == nil && result.Status != "" && !strings.EqualFold(result.Status, "OK") {
+			return stratumserver.VerdictRejected, result.Status
+		}
+	}
+	return stratumserver.VerdictAccepted, ""
+}
+
+// isStaleReason returns true if the pool rejected the share because its job is outdated
+func isStaleReason(reason string) bool {
+	reason = strings.ToLower(reason)
+	for _, v := range []string{"stale", "expired", "outdated", "old job", "unknown job"} {
+		if strings.Contains(reason, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolErrorMessage returns the message of an error returned by a pool
+func poolErrorMessage(e any) string {
+	if m, ok := e.(map[string]any); ok {
+		if msg, ok := m["message"].(string); ok {
+			return msg
+		}
+	}
+	return fmt.Sprint(e)
+}
+
+type PoolShareInfo struct {
+	Url    string                    `json:"url"`
+	Shares stratumserver.ShareCounts `json:"shares"`
+	// Hashrate is estimated from the accepted shares
+	Hashrate float64 `json:"hashrate"`
+	// LastShare is a unix timestamp, 0 if no share was accepted
+	LastShare int64 `json:"last_share"`
+}
+
+// ListPoolShares returns the share stats of the pools since the proxy started, sorted by
+// url
+func ListPoolShares() []PoolShareInfo {
+	UpstreamsMut.Lock()
+	stats := make(map[string]*stratumserver.ShareStats, len(poolShares))
+	for k, v := range poolShares {
+		stats[k] = v
+	}
+	UpstreamsMut.Unlock()
+
+	infos := make([]PoolShareInfo, 0, len(stats))
+	for url, s := range stats {
+		info := PoolShareInfo{
+			Url:      url,
+			Shares:   s.Counts(),
+			Hashrate: s.Hashrate(startTime),
+		}
+		if !info.Shares.LastAccepted.IsZero() {
+			info.LastShare = info.Shares.LastAccepted.Unix()
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Url < infos[j].Url
+	})
+	return infos
+}
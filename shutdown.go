@@ -0,0 +1,104 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"kiloproxy/config"
+	"kiloproxy/kilolog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Number of shares submitted to the pools and still waiting for a response, updated atomically
+var pendingSubmits int64
+
+var shuttingDown int32
+
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// WaitForShutdown blocks until SIGTERM or SIGINT is received, then shuts down the
+// proxy gracefully and returns the exit code. A second signal forces the exit.
+func WaitForShutdown() int {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+
+	sig := <-sigs
+	kilolog.Info("Received", sig.String()+", shutting down")
+
+	go func() {
+		<-sigs
+		kilolog.Warn("Forced shutdown")
+		os.Exit(1)
+	}()
+
+	return Shutdown()
+}
+
+// Shutdown stops accepting new miners, waits for the pending shares to be answered by
+// the pools, then closes the miners and the upstreams. Returns the exit code.
+func Shutdown() int {
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	srv.Stop()
+
+	exitCode := 0
+
+	deadline := time.Now().Add(config.SHUTDOWN_TIMEOUT_SECONDS * time.Second)
+	for atomic.LoadInt64(&pendingSubmits) > 0 {
+		if time.Now().After(deadline) {
+			kilolog.Warn("Timed out waiting for", atomic.LoadInt64(&pendingSubmits), "pending shares")
+			exitCode = 1
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	srv.ConnsMut.Lock()
+	ids := make([]uint64, 0, len(srv.Connections))
+	for _, v := range srv.Connections {
+		ids = append(ids, v.Id)
+	}
+	srv.ConnsMut.Unlock()
+
+	kilolog.Info("Disconnecting", len(ids), "miners")
+	for _, id := range ids {
+		KickFor(id, "shutdown")
+	}
+
+	UpstreamsMut.Lock()
+	for _, us := range Upstreams {
+		us.Close()
+	}
+	UpstreamsMut.Unlock()
+
+	PrintStats()
+
+	err := SaveStats()
+	if err != nil {
+		kilolog.Err("Failed to save the stats:", err)
+	}
+
+	kilolog.Info("Shutdown complete")
+	return exitCode
+}
@@ -22,19 +22,29 @@ import (
 	"kiloproxy/config"
 	"kiloproxy/kilolog"
 	"strconv"
+	"sync"
 	"time"
 )
 
 var numMiners, numUpstreams int
 var avgHashrate float64
 
+// Shares rejected locally by the proxy, updated atomically
+var staleShares, duplicateShares, invalidShares uint64
+
 type FoundShare struct {
-	Time time.Time
-	Diff uint64
+	Time time.Time `json:"time"`
+	Diff uint64    `json:"diff"`
 }
 
+// foundShares holds the accepted shares of the last HASHRATE_AVG_MINUTES, at miner
+// difficulty. It's protected by foundSharesMut.
+var foundSharesMut sync.Mutex
 var foundShares = make([]FoundShare, 10)
 
+// startTime is when the proxy started
+var startTime = time.Now()
+
 func formatHashrate(f float64) string {
 	if f > 1000*1000 {
 		return strconv.FormatFloat(f/1000/1000, 'f', 1, 64) + " M"
@@ -51,16 +61,45 @@ type Hr struct {
 	Miners int     `json:"miners"`
 }
 
-var hrChart = make([]Hr, 0, 288)
+// hrChartMut protects hrChart
+var hrChartMut sync.Mutex
+var hrChart = make([]Hr, 0, config.HR_CHART_SAMPLES)
+
+// HrChart returns a copy of the hashrate chart
+func HrChart() []Hr {
+	hrChartMut.Lock()
+	defer hrChartMut.Unlock()
+
+	return append([]Hr{}, hrChart...)
+}
+
+// nextChartSample returns when the next chart sample is due. After a restart, the samples
+// continue from the last restored one.
+func nextChartSample() time.Time {
+	interval := config.HR_CHART_INTERVAL_MINUTES * time.Minute
+
+	hrChartMut.Lock()
+	defer hrChartMut.Unlock()
+
+	if len(hrChart) == 0 {
+		return time.Now().Add(interval)
+	}
+	next := time.Unix(hrChart[len(hrChart)-1].Time, 0).Add(interval)
+	if next.Before(time.Now()) {
+		return time.Now()
+	}
+	return next
+}
 
 func Stats() {
 	go func() {
 		for {
-			time.Sleep(5 * time.Minute)
+			time.Sleep(time.Until(nextChartSample()))
 
 			getStats()
 
-			if len(hrChart) == 288 {
+			hrChartMut.Lock()
+			if len(hrChart) == config.HR_CHART_SAMPLES {
 				hrChart = hrChart[1:]
 			}
 
@@ -69,21 +108,28 @@ func Stats() {
 				Time:   time.Now().Unix(),
 				Miners: numMiners,
 			})
+			hrChartMut.Unlock()
 		}
 	}()
 
 	for {
-		getStats()
-		kilolog.Statsf("%s avg, miners: "+kilolog.COLOR_CYAN+"%d"+kilolog.COLOR_WHITE+", upstreams: "+kilolog.COLOR_CYAN+"%d"+kilolog.COLOR_WHITE,
-			kilolog.COLOR_CYAN+formatHashrate(avgHashrate)+"H/s"+kilolog.COLOR_WHITE,
-			numMiners,
-			numUpstreams,
-		)
-		time.Sleep(time.Duration(config.CFG.PrintInterval) * time.Second)
+		PrintStats()
+		time.Sleep(time.Duration(config.Get().PrintInterval) * time.Second)
 	}
 }
 
+func PrintStats() {
+	getStats()
+	c := kilolog.GetColors()
+	kilolog.Statsf("%s avg, miners: "+c.Cyan+"%d"+c.White+", upstreams: "+c.Cyan+"%d"+c.White,
+		c.Cyan+formatHashrate(avgHashrate)+"H/s"+c.White,
+		numMiners,
+		numUpstreams,
+	)
+}
+
 func getStats() {
+	foundSharesMut.Lock()
 	shares2 := make([]FoundShare, 0, len(foundShares))
 	var totalDiff float64
 
@@ -94,6 +140,7 @@ func getStats() {
 		}
 	}
 	foundShares = shares2
+	foundSharesMut.Unlock()
 
 	avgHashrate = totalDiff / (config.HASHRATE_AVG_MINUTES * 60)
 
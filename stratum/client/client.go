@@ -43,15 +43,22 @@ type SubmitWorkResult struct {
 }
 
 type Client struct {
-	destination     string
-	conn            net.Conn
-	responseChannel chan *rpc.Response
+	destination string
+	conn        net.Conn
+
+	// pending holds the channels awaiting the response of each request sent to the pool,
+	// by request ID. It's nil when the connection is closed.
+	pending map[uint64]chan *rpc.Response
+	// lastRequestId is never reset, so a late response can't match a newer request
+	lastRequestId uint64
 
 	ClientId string
 
 	mutex mutex.Mutex
 
 	alive bool
+	// fingerprint is the SHA-256 fingerprint of the pool certificate, empty without TLS
+	fingerprint string
 }
 
 func (cl *Client) IsAlive() bool {
@@ -60,6 +67,12 @@ func (cl *Client) IsAlive() bool {
 	return cl.alive
 }
 
+func (cl *Client) Fingerprint() string {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.fingerprint
+}
+
 // Connect to the stratum server port with the given login info. Returns error if connection could
 // not be established, or if the stratum server itself returned an error. In the latter case,
 // code and message will also be specified. If the stratum server returned just a warning, then
@@ -71,13 +84,16 @@ func (cl *Client) Connect(
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
 	cl.destination = destination
+	cl.fingerprint = ""
 
 	if useTLS {
-		cl.conn, err = tls.Dial("tcp", destination, &tls.Config{
+		cl.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: time.Second * 30}, "tcp", destination, &tls.Config{
 			InsecureSkipVerify: true,
 			VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 				computedFingerprint := sha256.Sum256(rawCerts[0])
 				computedFingerprintStr := hex.EncodeToString(computedFingerprint[:])
+				// the mutex is held by Connect
+				cl.fingerprint = computedFingerprintStr
 
 				if tlsFingerprint == "" {
 					kilolog.Info("Pool fingerprint", computedFingerprintStr)
@@ -105,6 +121,12 @@ func (cl *Client) Connect(
 		kilolog.Warn("Connection failed:", err, cl)
 		return nil, err
 	}
+	defer func() {
+		// the login failed
+		if err != nil {
+			cl.conn.Close()
+		}
+	}()
 	// send login
 	loginRequest := &struct {
 		ID     uint64 `json:"id"`
@@ -156,28 +178,41 @@ func (cl *Client) Connect(
 		kilolog.Warn("malformed login response:", response)
 		return nil, errors.New("malformed login response")
 	}
-
-	cl.responseChannel = make(chan *rpc.Response)
-	cl.alive = true
-	jc := make(chan *rpc.CompleteJob)
 	if response.Result.Job == nil {
 		kilolog.Warn("malformed login response: result:", response.Result)
 		return nil, fmt.Errorf("malformed login response")
 	}
 
+	// the login request used ID 1
+	if cl.lastRequestId == 0 {
+		cl.lastRequestId = 1
+	}
+	cl.pending = make(map[uint64]chan *rpc.Response)
+	cl.alive = true
+	jc := make(chan *rpc.CompleteJob)
+
 	cl.ClientId = response.Result.ID
 
-	go cl.dispatchJobs(cl.conn, jc, response.Result.Job, cl.responseChannel)
+	go cl.dispatchJobs(cl.conn, jc, response.Result.Job, cl.pending)
 	return jc, nil
 }
 
-func (cl *Client) submitRequest(requestData any, expectedResponseID uint64) (*rpc.Response, error) {
+// submitRequest sends a request to the pool with a new request ID, and waits for its
+// response. Many requests can be awaiting their response at the same time.
+func (cl *Client) submitRequest(method string, params any) (*rpc.Response, error) {
 	cl.mutex.Lock()
-	if !cl.alive {
+	if !cl.alive || cl.pending == nil {
 		cl.mutex.Unlock()
 		return nil, errors.New("client is not alive")
 	}
-	data, err := json.Marshal(requestData)
+	cl.lastRequestId++
+	id := cl.lastRequestId
+
+	data, err := json.Marshal(&struct {
+		ID     uint64 `json:"id"`
+		Method string `json:"method"`
+		Params any    `json:"params"`
+	}{id, method, params})
 	if err != nil {
 		kilolog.Warn("failed to submit work:", err)
 		cl.mutex.Unlock()
@@ -188,42 +223,50 @@ func (cl *Client) submitRequest(requestData any, expectedResponseID uint64) (*rp
 	data = append(data, '\n')
 	if _, err = cl.conn.Write(data); err != nil {
 		kilolog.Warn("failed to submit work:", err)
+		cl.alive = false
+		cl.conn.Close()
 		cl.mutex.Unlock()
 		return nil, err
 	}
-	respChan := cl.responseChannel
+	// buffered, so the dispatcher never waits for a request that timed out
+	respChan := make(chan *rpc.Response, 1)
+	cl.pending[id] = respChan
 	cl.mutex.Unlock()
 
 	// await the response
-	response := <-respChan
-	if response == nil {
-		return nil, fmt.Errorf("failed to submit work: empty response")
-	}
-	if response.ID != expectedResponseID {
-		kilolog.Warn("unexpected response ID: got:", response.ID, "expected:", expectedResponseID)
-
-		return nil, fmt.Errorf("failed to submit work: unexpected response")
+	select {
+	case response := <-respChan:
+		if response == nil {
+			return nil, errors.New("failed to submit work: connection closed")
+		}
+		return response, nil
+	case <-time.After(config.SUBMIT_TIMEOUT_SECONDS * time.Second):
+		cl.mutex.Lock()
+		if cl.pending != nil {
+			delete(cl.pending, id)
+		}
+		cl.mutex.Unlock()
+		return nil, fmt.Errorf("failed to submit work: no response after %d seconds", config.SUBMIT_TIMEOUT_SECONDS)
 	}
-	return response, nil
 }
 
-// If error is returned by this method, then client will be closed and put in not-alive state.
+// SubmitWork sends a share to the pool. The ID of the returned response is the miner's
+// request ID, as the pool's response is to the client's own request ID.
+// An error is returned if the share couldn't be sent, in which case the client is closed
+// and put in not-alive state, if the connection closed before the response, or if the
+// pool didn't answer in SUBMIT_TIMEOUT_SECONDS. A timeout leaves the client alive.
 func (cl *Client) SubmitWork(nonce, jobid, result string, id uint64) (*rpc.Response, error) {
-	submitRequest := &struct {
-		ID     uint64      `json:"id"`
-		Method string      `json:"method"`
-		Params interface{} `json:"params"`
-	}{
-		ID:     id,
-		Method: "submit",
-		Params: &struct {
-			ID     string `json:"id"`
-			JobID  string `json:"job_id"`
-			Nonce  string `json:"nonce"`
-			Result string `json:"result"`
-		}{cl.ClientId, jobid, nonce, result},
+	response, err := cl.submitRequest("submit", &struct {
+		ID     string `json:"id"`
+		JobID  string `json:"job_id"`
+		Nonce  string `json:"nonce"`
+		Result string `json:"result"`
+	}{cl.ClientId, jobid, nonce, result})
+	if err != nil {
+		return nil, err
 	}
-	return cl.submitRequest(submitRequest, id)
+	response.ID = id
+	return response, nil
 }
 
 func (cl *Client) Close() {
@@ -236,12 +279,22 @@ func (cl *Client) Close() {
 	cl.conn.Close()
 }
 
-// dispatchJobs will forward incoming jobs to the JobChannel until error is received or the
-// connection is closed. Client will be in not-alive state on return.
-func (cl *Client) dispatchJobs(conn net.Conn, jobChan chan<- *rpc.CompleteJob, firstJob *rpc.CompleteJob, responseChan chan<- *rpc.Response) {
+// dispatchJobs will forward incoming jobs to the JobChannel, and the responses to the
+// pending requests, until error is received or the connection is closed. Client will be in
+// not-alive state on return, and the pending requests fail.
+func (cl *Client) dispatchJobs(conn net.Conn, jobChan chan<- *rpc.CompleteJob, firstJob *rpc.CompleteJob, pending map[uint64]chan *rpc.Response) {
 	defer func() {
 		close(jobChan)
-		close(responseChan)
+
+		cl.mutex.Lock()
+		for id, respChan := range pending {
+			close(respChan)
+			delete(pending, id)
+		}
+		if cl.conn == conn {
+			cl.pending = nil
+		}
+		cl.mutex.Unlock()
 	}()
 	jobChan <- firstJob
 	reader := bufio.NewReaderSize(conn, config.MAX_REQUEST_SIZE)
@@ -250,7 +303,7 @@ func (cl *Client) dispatchJobs(conn net.Conn, jobChan chan<- *rpc.CompleteJob, f
 		conn.SetReadDeadline(time.Now().Add(5 * 60 * time.Second))
 		err := rpc.ReadJSON(response, reader)
 		if err != nil {
-			if cl.alive {
+			if cl.IsAlive() {
 				kilolog.Warn("failed to read jobs from pool:", err)
 				break
 			} else {
@@ -259,7 +312,16 @@ func (cl *Client) dispatchJobs(conn net.Conn, jobChan chan<- *rpc.CompleteJob, f
 			}
 		}
 		if response.Method != "job" {
-			responseChan <- response
+			cl.mutex.Lock()
+			respChan := pending[response.ID]
+			delete(pending, response.ID)
+			cl.mutex.Unlock()
+
+			if respChan == nil {
+				kilolog.Warn("unexpected response ID from pool:", response.ID)
+				continue
+			}
+			respChan <- response
 			continue
 		}
 
@@ -0,0 +1,398 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// package daemonclient implements solo mining against a monerod-compatible daemon, using
+// the get_block_template and submit_block JSON-RPC methods
+package daemonclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kiloproxy/config"
+	"kiloproxy/kilolog"
+	"kiloproxy/mutex"
+	"kiloproxy/stratum/rpc"
+	"kiloproxy/stratum/template"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Size of the extra nonce in the miner transaction: 4 random bytes for this proxy
+// instance, and a 4-byte counter for the upstream
+const reserveSize = 8
+
+var instanceNonce = make([]byte, 4)
+var lastExtraNonce uint32
+
+func init() {
+	rand.Read(instanceNonce)
+}
+
+type blockJob struct {
+	template.Template
+	Parsed   *template.ParsedBlock
+	PrevHash string
+}
+
+type Client struct {
+	url        string
+	wallet     string
+	extraNonce []byte
+	httpClient *http.Client
+
+	ClientId string
+
+	// jobs holds the recent jobs by job ID
+	jobs      map[string]*blockJob
+	jobIds    []string
+	lastJobId uint64
+
+	mutex mutex.Mutex
+	alive bool
+	stop  chan struct{}
+}
+
+func (cl *Client) IsAlive() bool {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.alive
+}
+
+// Connect fetches a first block template from the daemon, and returns a channel receiving a
+// new job every time the template changes. The rewards are sent to the wallet address.
+func (cl *Client) Connect(destination string, useTLS bool, wallet string) (<-chan *rpc.CompleteJob, error) {
+	cl.Close()
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	cl.url = scheme + "://" + destination + "/json_rpc"
+	cl.wallet = wallet
+	cl.httpClient = &http.Client{Timeout: 30 * time.Second}
+	cl.jobs = make(map[string]*blockJob)
+	cl.jobIds = nil
+
+	cl.extraNonce = make([]byte, reserveSize)
+	copy(cl.extraNonce, instanceNonce)
+	binary.BigEndian.PutUint32(cl.extraNonce[4:], atomic.AddUint32(&lastExtraNonce, 1))
+	cl.ClientId = hex.EncodeToString(cl.extraNonce)
+
+	bt, err := cl.getBlockTemplate()
+	if err != nil {
+		kilolog.Warn("Daemon connection failed:", err)
+		return nil, err
+	}
+	firstJob, err := cl.addJob(bt)
+	if err != nil {
+		return nil, err
+	}
+
+	cl.alive = true
+	cl.stop = make(chan struct{})
+
+	jc := make(chan *rpc.CompleteJob)
+	go cl.pollTemplates(jc, firstJob, bt.PrevHash, cl.stop)
+	return jc, nil
+}
+
+type blockTemplateResult struct {
+	BlocktemplateBlob string `json:"blocktemplate_blob"`
+	BlockhashingBlob  string `json:"blockhashing_blob"`
+	Difficulty        uint64 `json:"difficulty"`
+	Height            uint64 `json:"height"`
+	PrevHash          string `json:"prev_hash"`
+	ReservedOffset    int    `json:"reserved_offset"`
+	SeedHash          string `json:"seed_hash"`
+	Status            string `json:"status"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("daemon error %d: %s", e.Code, e.Message)
+}
+
+// call sends a JSON-RPC request to the daemon and decodes its result
+func (cl *Client) call(method string, params any, result any) error {
+	data, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      "0",
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	kilolog.Debug("sending to daemon:", string(data))
+
+	res, err := cl.httpClient.Post(cl.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("daemon returned HTTP status %d", res.StatusCode)
+	}
+
+	response := struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+func (cl *Client) getBlockTemplate() (*blockTemplateResult, error) {
+	bt := &blockTemplateResult{}
+	err := cl.call("get_block_template", map[string]any{
+		"wallet_address": cl.wallet,
+		"reserve_size":   reserveSize,
+	}, bt)
+	if err != nil {
+		return nil, err
+	}
+	if bt.Status != "" && bt.Status != "OK" {
+		return nil, errors.New("get_block_template failed: " + bt.Status)
+	}
+	return bt, nil
+}
+
+// addJob puts the client's extra nonce in the reserved space of the template, and returns
+// the job to send to the miners.
+// Note: cl.mutex must be locked before calling this
+func (cl *Client) addJob(bt *blockTemplateResult) (*rpc.CompleteJob, error) {
+	blob, err := hex.DecodeString(bt.BlocktemplateBlob)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := template.ParseBlock(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	// check the template is understood before changing it
+	if hex.EncodeToString(parsed.HashingBlob(blob)) != bt.BlockhashingBlob {
+		return nil, errors.New("hashing blob does not match the daemon's, unsupported block format")
+	}
+	if bt.ReservedOffset < parsed.MinerTxOffset || bt.ReservedOffset+reserveSize > parsed.MinerTxPrefixEnd {
+		return nil, errors.New("invalid reserved offset")
+	}
+	if bt.Difficulty == 0 {
+		return nil, errors.New("invalid block difficulty")
+	}
+	copy(blob[bt.ReservedOffset:], cl.extraNonce)
+
+	cl.lastJobId++
+	jobId := strconv.FormatUint(cl.lastJobId, 10)
+
+	if len(cl.jobIds) == config.RECENT_JOBS {
+		delete(cl.jobs, cl.jobIds[0])
+		cl.jobIds = cl.jobIds[1:]
+	}
+	cl.jobIds = append(cl.jobIds, jobId)
+	cl.jobs[jobId] = &blockJob{
+		Template: template.Template{
+			Blob:           blob,
+			Difficulty:     bt.Difficulty,
+			Height:         bt.Height,
+			ReservedOffset: bt.ReservedOffset,
+			SeedHash:       bt.SeedHash,
+		},
+		Parsed:   parsed,
+		PrevHash: bt.PrevHash,
+	}
+
+	job := &rpc.CompleteJob{}
+	job.Blob = hex.EncodeToString(parsed.HashingBlob(blob))
+	job.JobID = jobId
+	job.Target = hex.EncodeToString(template.DiffToTarget(bt.Difficulty))
+	job.Height = bt.Height
+	job.SeedHash = bt.SeedHash
+	return job, nil
+}
+
+// pollTemplates sends a new job when the daemon's chain tip changes, or every
+// DAEMON_REFRESH_SECONDS to include new transactions. The channel is closed when the
+// client is closed or the daemon failed DAEMON_MAX_FAILURES times in a row.
+func (cl *Client) pollTemplates(jobChan chan<- *rpc.CompleteJob, firstJob *rpc.CompleteJob, prevHash string, stop <-chan struct{}) {
+	defer close(jobChan)
+
+	jobChan <- firstJob
+	lastJob := time.Now()
+
+	failures := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(pollDelay(failures)):
+		}
+
+		bt, err := cl.getBlockTemplate()
+		if err != nil {
+			failures++
+			kilolog.Warn("failed to get block template from daemon:", err)
+			if failures >= config.DAEMON_MAX_FAILURES {
+				return
+			}
+			continue
+		}
+		if bt.PrevHash == prevHash && time.Since(lastJob) < config.DAEMON_REFRESH_SECONDS*time.Second {
+			failures = 0
+			continue
+		}
+
+		cl.mutex.Lock()
+		if !cl.alive {
+			cl.mutex.Unlock()
+			return
+		}
+		job, err := cl.addJob(bt)
+		cl.mutex.Unlock()
+		if err != nil {
+			failures++
+			kilolog.Warn("invalid block template from daemon:", err)
+			if failures >= config.DAEMON_MAX_FAILURES {
+				return
+			}
+			continue
+		}
+		failures = 0
+
+		if bt.PrevHash != prevHash {
+			kilolog.Info("New block template at height", bt.Height, "difficulty", bt.Difficulty)
+		}
+		prevHash = bt.PrevHash
+		lastJob = time.Now()
+
+		select {
+		case jobChan <- job:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// pollDelay returns the time to wait before polling the daemon, doubled after each
+// consecutive failure up to DAEMON_MAX_BACKOFF_SECONDS
+func pollDelay(failures int) time.Duration {
+	delay := config.DAEMON_POLL_SECONDS * time.Second
+	for i := 0; i < failures && delay < config.DAEMON_MAX_BACKOFF_SECONDS*time.Second; i++ {
+		delay *= 2
+	}
+	if delay > config.DAEMON_MAX_BACKOFF_SECONDS*time.Second {
+		delay = config.DAEMON_MAX_BACKOFF_SECONDS * time.Second
+	}
+	return delay
+}
+
+// SubmitWork puts the nonce in the block of the job and submits it to the daemon. The
+// result must already meet the block difficulty. The returned response is the one sent
+// to the miner.
+func (cl *Client) SubmitWork(nonce, jobid, result string, id uint64) (*rpc.Response, error) {
+	cl.mutex.Lock()
+	if !cl.alive {
+		cl.mutex.Unlock()
+		return nil, errors.New("client is not alive")
+	}
+	job := cl.jobs[jobid]
+	cl.mutex.Unlock()
+
+	if job == nil {
+		return errorResponse(id, -1, "Block expired"), nil
+	}
+
+	nonceBin, err := hex.DecodeString(nonce)
+	if err != nil || len(nonceBin) != 4 {
+		return errorResponse(id, -1, "Invalid nonce"), nil
+	}
+
+	blob := make([]byte, len(job.Blob))
+	copy(blob, job.Blob)
+	copy(blob[job.Parsed.NonceOffset:], nonceBin)
+
+	kilolog.Info("Submitting block at height", job.Height, "with result", result)
+
+	err = cl.call("submit_block", []string{hex.EncodeToString(blob)}, nil)
+	if err != nil {
+		var rpcErr *rpcError
+		if errors.As(err, &rpcErr) {
+			kilolog.Warn("Block rejected by the daemon:", rpcErr.Message)
+			return errorResponse(id, rpcErr.Code, "Block rejected: "+rpcErr.Message), nil
+		}
+		return nil, err
+	}
+
+	kilolog.Info("Block found at height", job.Height)
+
+	status := json.RawMessage(`{"status":"OK"}`)
+	return &rpc.Response{
+		ID:      id,
+		Jsonrpc: "2.0",
+		Result:  &status,
+	}, nil
+}
+
+func errorResponse(id uint64, code int, message string) *rpc.Response {
+	return &rpc.Response{
+		ID:      id,
+		Jsonrpc: "2.0",
+		Error: map[string]any{
+			"code":    code,
+			"message": message,
+		},
+	}
+}
+
+// Fingerprint is always empty, as the daemon certificate is not pinned
+func (cl *Client) Fingerprint() string {
+	return ""
+}
+
+func (cl *Client) Close() {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if !cl.alive {
+		return
+	}
+	cl.alive = false
+	close(cl.stop)
+}
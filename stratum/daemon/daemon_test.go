@@ -0,0 +1,322 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package daemonclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"kiloproxy/stratum/rpc"
+	"kiloproxy/stratum/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDaemon is a stand-in monerod serving get_block_template and submit_block
+type testDaemon struct {
+	mut      sync.Mutex
+	blob     []byte
+	reserved int
+	height   uint64
+	prevHash string
+	// hashingBlob replaces the daemon's hashing blob if not empty
+	hashingBlob string
+	// failures is the number of get_block_template calls to fail
+	failures  int
+	submitErr *rpcError
+	submitted [][]byte
+}
+
+func newTestDaemon(t *testing.T) (*testDaemon, *httptest.Server) {
+	d := &testDaemon{height: 3000000, prevHash: strings.Repeat("ab", 32)}
+	d.blob, d.reserved = testBlock(d.height)
+
+	srv := httptest.NewServer(http.HandlerFunc(d.handle))
+	t.Cleanup(srv.Close)
+	return d, srv
+}
+
+// testBlock returns a block template with a RingCT miner transaction, and the offset of
+// its reserved space
+func testBlock(height uint64) ([]byte, int) {
+	blob := []byte{16, 16}
+	blob = binary.AppendUvarint(blob, 1700000000)
+	blob = append(blob, bytes.Repeat([]byte{0xab}, 32)...)
+	blob = append(blob, 0, 0, 0, 0)
+
+	blob = append(blob, 2)
+	blob = binary.AppendUvarint(blob, height+60)
+	blob = append(blob, 1, 0xff)
+	blob = binary.AppendUvarint(blob, height)
+	blob = append(blob, 1)
+	blob = binary.AppendUvarint(blob, 600000000000)
+	blob = append(blob, 0x03)
+	blob = append(blob, bytes.Repeat([]byte{0xcd}, 32)...)
+	blob = append(blob, 0x5a)
+	blob = append(blob, 43, 0x01)
+	blob = append(blob, bytes.Repeat([]byte{0xef}, 32)...)
+	blob = append(blob, 0x02, reserveSize)
+	reserved := len(blob)
+	blob = append(blob, make([]byte, reserveSize)...)
+	blob = append(blob, 0)
+
+	blob = append(blob, 1)
+	blob = append(blob, bytes.Repeat([]byte{0x11}, 32)...)
+	return blob, reserved
+}
+
+func (d *testDaemon) handle(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}{}
+	if r.URL.Path != "/json_rpc" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	var result any
+	var rpcErr *rpcError
+	switch req.Method {
+	case "get_block_template":
+		if d.failures > 0 {
+			d.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		hashingBlob := d.hashingBlob
+		if hashingBlob == "" {
+			parsed, err := template.ParseBlock(d.blob)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			hashingBlob = hex.EncodeToString(parsed.HashingBlob(d.blob))
+		}
+		result = blockTemplateResult{
+			BlocktemplateBlob: hex.EncodeToString(d.blob),
+			BlockhashingBlob:  hashingBlob,
+			Difficulty:        300000000000,
+			Height:            d.height,
+			PrevHash:          d.prevHash,
+			ReservedOffset:    d.reserved,
+			SeedHash:          strings.Repeat("cd", 32),
+			Status:            "OK",
+		}
+	case "submit_block":
+		params := []string{}
+		json.Unmarshal(req.Params, &params)
+		if len(params) == 1 {
+			blob, _ := hex.DecodeString(params[0])
+			d.submitted = append(d.submitted, blob)
+		}
+		if d.submitErr != nil {
+			rpcErr = d.submitErr
+		} else {
+			result = map[string]string{"status": "OK"}
+		}
+	default:
+		rpcErr = &rpcError{Code: -32601, Message: "Method not found"}
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      "0",
+		"result":  result,
+		"error":   rpcErr,
+	})
+}
+
+// newBlock makes the daemon serve a template for the next height
+func (d *testDaemon) newBlock() {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.height++
+	d.blob, d.reserved = testBlock(d.height)
+	d.prevHash = fmt.Sprintf("%064x", d.height)
+}
+
+func connect(t *testing.T, srv *httptest.Server) (*Client, <-chan *rpc.CompleteJob, *rpc.CompleteJob) {
+	cl := &Client{}
+	jobChan, err := cl.Connect(strings.TrimPrefix(srv.URL, "http://"), false, "wallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cl.Close)
+	return cl, jobChan, <-jobChan
+}
+
+func nextJob(t *testing.T, jobChan <-chan *rpc.CompleteJob, timeout time.Duration) *rpc.CompleteJob {
+	select {
+	case job := <-jobChan:
+		return job
+	case <-time.After(timeout):
+		t.Fatal("no job received")
+		return nil
+	}
+}
+
+func TestConnect(t *testing.T) {
+	d, srv := newTestDaemon(t)
+	cl, _, job := connect(t, srv)
+
+	if len(cl.ClientId) != 2*reserveSize {
+		t.Fatalf("client ID %s, expected %d hex bytes", cl.ClientId, reserveSize)
+	}
+	blob := append([]byte{}, d.blob...)
+	extraNonce, _ := hex.DecodeString(cl.ClientId)
+	copy(blob[d.reserved:], extraNonce)
+	parsed, err := template.ParseBlock(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.JobID != "1" || job.Height != d.height || job.SeedHash != strings.Repeat("cd", 32) {
+		t.Errorf("job %s at height %d with seed hash %s", job.JobID, job.Height, job.SeedHash)
+	}
+	if expected := hex.EncodeToString(parsed.HashingBlob(blob)); job.Blob != expected {
+		t.Errorf("job blob %s, expected %s", job.Blob, expected)
+	}
+	if expected := hex.EncodeToString(template.DiffToTarget(300000000000)); job.Target != expected {
+		t.Errorf("job target %s, expected %s", job.Target, expected)
+	}
+}
+
+func TestConnectErrors(t *testing.T) {
+	d, srv := newTestDaemon(t)
+	d.hashingBlob = "00"
+	cl := &Client{}
+	if _, err := cl.Connect(strings.TrimPrefix(srv.URL, "http://"), false, "wallet"); err == nil {
+		t.Error("connected with a hashing blob not matching the template")
+	}
+
+	d, srv = newTestDaemon(t)
+	d.failures = 1
+	if _, err := cl.Connect(strings.TrimPrefix(srv.URL, "http://"), false, "wallet"); err == nil {
+		t.Error("connected to a failing daemon")
+	}
+	if cl.IsAlive() {
+		t.Error("client is alive after a failed connection")
+	}
+}
+
+func TestSubmitWork(t *testing.T) {
+	d, srv := newTestDaemon(t)
+	cl, _, job := connect(t, srv)
+
+	res, err := cl.SubmitWork("01020304", job.JobID, strings.Repeat("00", 32), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != 7 || res.Error != nil || res.Result == nil || string(*res.Result) != `{"status":"OK"}` {
+		t.Fatalf("unexpected response %+v", res)
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if len(d.submitted) != 1 {
+		t.Fatalf("%d blocks submitted, expected 1", len(d.submitted))
+	}
+	block := d.submitted[0]
+	parsed, err := template.ParseBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce := hex.EncodeToString(block[parsed.NonceOffset : parsed.NonceOffset+4]); nonce != "01020304" {
+		t.Errorf("block nonce %s, expected 01020304", nonce)
+	}
+	if extraNonce := hex.EncodeToString(block[d.reserved : d.reserved+reserveSize]); extraNonce != cl.ClientId {
+		t.Errorf("block extra nonce %s, expected %s", extraNonce, cl.ClientId)
+	}
+	if len(block) != len(d.blob) {
+		t.Errorf("block size %d, expected %d", len(block), len(d.blob))
+	}
+}
+
+func TestSubmitWorkErrors(t *testing.T) {
+	d, srv := newTestDaemon(t)
+	cl, _, job := connect(t, srv)
+	d.submitErr = &rpcError{Code: -7, Message: "Block not accepted"}
+
+	tests := []struct {
+		name    string
+		nonce   string
+		jobId   string
+		message string
+	}{
+		{"unknown job", "01020304", "bogus", "Block expired"},
+		{"invalid nonce", "0102", job.JobID, "Invalid nonce"},
+		{"rejected block", "01020304", job.JobID, "Block rejected: Block not accepted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := cl.SubmitWork(tt.nonce, tt.jobId, strings.Repeat("00", 32), 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, _ := res.Error.(map[string]any)
+			if res.ID != 3 || e == nil || e["message"] != tt.message {
+				t.Errorf("response %+v, expected the error %q", res, tt.message)
+			}
+		})
+	}
+}
+
+func TestPollTemplates(t *testing.T) {
+	d, srv := newTestDaemon(t)
+	cl, jobChan, _ := connect(t, srv)
+
+	d.newBlock()
+	job := nextJob(t, jobChan, 3*time.Second)
+	if job.JobID != "2" || job.Height != d.height {
+		t.Errorf("job %s at height %d, expected job 2 at height %d", job.JobID, job.Height, d.height)
+	}
+
+	// a failing daemon is polled again
+	d.mut.Lock()
+	d.failures = 2
+	d.mut.Unlock()
+	d.newBlock()
+	job = nextJob(t, jobChan, 10*time.Second)
+	if job == nil || job.JobID != "3" {
+		t.Errorf("job %+v, expected job 3", job)
+	}
+
+	cl.Close()
+	for {
+		select {
+		case job, ok := <-jobChan:
+			if !ok {
+				return
+			}
+			t.Errorf("unexpected job %s after closing", job.JobID)
+		case <-time.After(3 * time.Second):
+			t.Fatal("job channel not closed")
+		}
+	}
+}
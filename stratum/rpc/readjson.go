@@ -22,21 +22,26 @@ import (
 	"bufio"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"kiloproxy/kilolog"
 )
 
+// ErrMalformed is returned by ReadJSON when the peer sent invalid data, as opposed to a
+// connection error
+var ErrMalformed = errors.New("malformed request")
+
 func ReadJSON(response any, reader *bufio.Reader) error {
 	data, isPrefix, err := reader.ReadLine()
 
 	if isPrefix {
-		return errors.New("request")
+		return fmt.Errorf("%w: request is too long", ErrMalformed)
 	} else if err != nil {
 		return err
 	}
 	err = json.Unmarshal(data, response)
 	if err != nil {
 		kilolog.Warn("json unmarshal failed:", err)
-		return err
+		return fmt.Errorf("%w: %s", ErrMalformed, err)
 	}
 	return nil
 }
@@ -0,0 +1,63 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package stratumserver
+
+import (
+	"kiloproxy/config"
+	"time"
+)
+
+// HashrateWindow estimates a hashrate from the difficulty of the shares found in the last
+// HASHRATE_AVG_MINUTES minutes, counted in one-minute buckets
+type HashrateWindow struct {
+	diffs   [config.HASHRATE_AVG_MINUTES]uint64
+	minutes [config.HASHRATE_AVG_MINUTES]int64
+}
+
+func (w *HashrateWindow) Add(diff uint64) {
+	minute := time.Now().Unix() / 60
+	i := minute % config.HASHRATE_AVG_MINUTES
+	if w.minutes[i] != minute {
+		w.minutes[i] = minute
+		w.diffs[i] = 0
+	}
+	w.diffs[i] += diff
+}
+
+// Hashrate returns the average hashrate of the window. The average starts at since if it's
+// in the window, but covers at least HASHRATE_MIN_SECONDS to avoid spikes.
+func (w *HashrateWindow) Hashrate(since time.Time) float64 {
+	minute := time.Now().Unix() / 60
+
+	var total uint64
+	for i, v := range w.minutes {
+		if minute-v < config.HASHRATE_AVG_MINUTES {
+			total += w.diffs[i]
+		}
+	}
+
+	seconds := time.Since(since).Seconds()
+	if seconds > config.HASHRATE_AVG_MINUTES*60 {
+		seconds = config.HASHRATE_AVG_MINUTES * 60
+	}
+	if seconds < config.HASHRATE_MIN_SECONDS {
+		seconds = config.HASHRATE_MIN_SECONDS
+	}
+	return float64(total) / seconds
+}
@@ -0,0 +1,182 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package stratumserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// HAProxy PROXY protocol, see https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+
+var proxyV1Prefix = []byte("PROXY ")
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maximum length of a v1 header, including the CRLF
+const proxyV1MaxLength = 107
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyConn is a connection whose PROXY header has been read. Reads start after the
+// header, and RemoteAddr returns the address of the client behind the proxy.
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readProxyHeader reads a v1 or v2 PROXY header from the connection. The header is
+// mandatory, but LOCAL and UNKNOWN headers keep the address of the proxy.
+func readProxyHeader(c net.Conn) (*proxyConn, error) {
+	pc := &proxyConn{
+		Conn:       c,
+		reader:     bufio.NewReader(c),
+		remoteAddr: c.RemoteAddr(),
+	}
+
+	// the v1 prefix is shorter than the v2 signature, peek it first so a short v1 header
+	// isn't waiting for more data
+	prefix, err := pc.reader.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	var addr net.Addr
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		addr, err = readProxyV1(pc.reader)
+	} else if bytes.HasPrefix(proxyV2Signature, prefix) {
+		addr, err = readProxyV2(pc.reader)
+	} else {
+		return nil, errProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr != nil {
+		pc.remoteAddr = addr
+	}
+	return pc, nil
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == proxyV1MaxLength {
+			return nil, errProxyHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+
+	// PROXY TCP4|TCP6 <src ip> <dst ip> <src port> <dst port>, or PROXY UNKNOWN ...
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, errProxyHeader
+	}
+
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	switch verCmd & 0x0f {
+	case 0x0:
+		// LOCAL: a health check from the proxy itself
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, errProxyHeader
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default:
+		// unspecified, UDP or unix sockets: keep the proxy's address
+		return nil, nil
+	}
+}
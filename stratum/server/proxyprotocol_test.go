@@ -0,0 +1,131 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package stratumserver
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header returns a v2 header with the given version and command, address family
+// and payload
+func proxyV2Header(verCmd, family byte, payload []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, verCmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return string(append(header, payload...))
+}
+
+func proxyV2TCP4() []byte {
+	payload := []byte{192, 0, 2, 1, 198, 51, 100, 1}
+	payload = binary.BigEndian.AppendUint16(payload, 56324)
+	return binary.BigEndian.AppendUint16(payload, 3333)
+}
+
+func proxyV2TCP6() []byte {
+	payload := append([]byte{}, net.ParseIP("2001:db8::1")...)
+	payload = append(payload, net.ParseIP("2001:db8::2")...)
+	payload = binary.BigEndian.AppendUint16(payload, 56324)
+	return binary.BigEndian.AppendUint16(payload, 3333)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		// addr is the expected remote address, "pipe" for the proxy's, empty if the
+		// header must be refused
+		addr string
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 3333\r\n", "192.0.2.1:56324"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 3333\r\n", "[2001:db8::1]:56324"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "pipe"},
+		{"v1 unknown with addresses", "PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 3333\r\n", "pipe"},
+		{"v1 tcp4 with an ipv6 address", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 3333\r\n", ""},
+		{"v1 unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 56324 3333\r\n", ""},
+		{"v1 missing port", "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", ""},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 3333\r\n", ""},
+		{"v1 invalid address", "PROXY TCP4 192.0.2 198.51.100.1 56324 3333\r\n", ""},
+		{"v1 without cr", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 3333\n", ""},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", ""},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1", ""},
+		{"v1 truncated prefix", "PROX", ""},
+		{"v2 tcp4", proxyV2Header(0x21, 0x11, proxyV2TCP4()), "192.0.2.1:56324"},
+		{"v2 tcp6", proxyV2Header(0x21, 0x21, proxyV2TCP6()), "[2001:db8::1]:56324"},
+		{"v2 tcp4 with tlvs", proxyV2Header(0x21, 0x11, append(proxyV2TCP4(), 0x04, 0, 1, 0)), "192.0.2.1:56324"},
+		{"v2 local", proxyV2Header(0x20, 0x00, nil), "pipe"},
+		{"v2 udp", proxyV2Header(0x21, 0x12, proxyV2TCP4()), "pipe"},
+		{"v2 invalid version", proxyV2Header(0x11, 0x11, proxyV2TCP4()), ""},
+		{"v2 invalid command", proxyV2Header(0x22, 0x11, proxyV2TCP4()), ""},
+		{"v2 short tcp4 payload", proxyV2Header(0x21, 0x11, proxyV2TCP4()[:6]), ""},
+		{"v2 short tcp6 payload", proxyV2Header(0x21, 0x21, proxyV2TCP4()), ""},
+		{"v2 invalid signature", "\r\n\r\n\x00\r\nQUIZ\n" + proxyV2Header(0x21, 0x11, proxyV2TCP4())[12:], ""},
+		{"v2 truncated signature", string(proxyV2Signature[:8]), ""},
+		{"v2 truncated payload", proxyV2Header(0x21, 0x11, proxyV2TCP4())[:20], ""},
+		{"no header", `{"id":1,"method":"login"}` + "\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write([]byte(tt.header + "payload"))
+				client.Close()
+			}()
+			server.SetReadDeadline(time.Now().Add(time.Second))
+
+			pc, err := readProxyHeader(server)
+			if tt.addr == "" {
+				if err == nil {
+					t.Fatalf("header accepted, remote address %s", pc.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr := pc.RemoteAddr().String(); addr != tt.addr {
+				t.Errorf("remote address %s, expected %s", addr, tt.addr)
+			}
+			data, err := io.ReadAll(pc)
+			if err != nil || string(data) != "payload" {
+				t.Errorf("read %q after the header (%v), expected the payload", data, err)
+			}
+		})
+	}
+}
+
+// A short v1 header must be read without waiting for the miner's first request
+func TestReadProxyHeaderShortV1(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err := readProxyHeader(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"kiloproxy/config"
 	"kiloproxy/kilolog"
@@ -37,6 +38,7 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -45,13 +47,54 @@ type Server struct {
 	ConnsMut    mutex.Mutex
 
 	NewConnections chan *Connection
+
+	// AllowConnection is called for every accepted connection, which is closed right away
+	// if it returns false
+	AllowConnection func(addr net.Addr, port uint16) bool
+
+	listeners map[string]net.Listener
+	stopped   bool
 }
 
 type Connection struct {
 	Conn net.Conn
 	Id   uint64
 
+	// BindPort is the port of the bind the miner connected to
+	BindPort uint16
+	// RemoteAddr is the address of the miner, from the PROXY header if the bind uses it
+	RemoteAddr net.Addr
+	Tls        bool
+	Connected  time.Time
+
+	Login string
+	Agent string
+	RigId string
+	// LoggedIn is set once the miner received its login response
+	LoggedIn atomic.Bool
+	// Algos is the list of algorithms supported by the miner, empty if it didn't send one
+	Algos []string
+	// Algo is the algorithm of the last job sent to the miner, protected by the proxy's
+	// upstreams mutex
+	Algo string
+
+	// Simple is true if the miner doesn't support nicehash mode, and has its own upstream
+	Simple bool
+
+	// Group is the pool group the miner is routed to, empty for the default group
+	Group    string
 	Upstream uint64
+	// Nicehash is the nicehash byte of the last job sent to the miner
+	Nicehash byte
+
+	// Diff is the difficulty of the last job sent to the miner
+	Diff uint64
+	// Shares is the number of shares accepted since LastRetarget
+	Shares       uint64
+	LastRetarget time.Time
+
+	// ShareStats counts the shares since the miner connected, at miner difficulty
+	ShareStats ShareStats
 
 	mutex.Mutex
 }
@@ -137,62 +180,160 @@ func GenCertificate() ([]byte, []byte, error) {
 	return certPem, keyPem, os.WriteFile("./certificate.pem", certPem, 0o666)
 }
 
-func (s *Server) Start(port uint16, bind string, isTls bool) {
-	if s.NewConnections == nil {
-		s.NewConnections = make(chan *Connection, 1)
-	}
+// LoadCertificate loads certificate.pem and key.pem, generating them if they can't be loaded
+func LoadCertificate() (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair("./certificate.pem", "key.pem")
 
-	var listener net.Listener
-	var err error
-	if isTls {
-		cert, err := tls.LoadX509KeyPair("./certificate.pem", "key.pem")
+	if err != nil {
+		kilolog.Info("Failed to load TLS certificate from file, generating a new one.")
+		kilolog.Debug(err)
 
+		certPem, keyPem, err := GenCertificate()
 		if err != nil {
-			kilolog.Info("Failed to load TLS certificate from file, generating a new one.")
-			kilolog.Debug(err)
-
-			certPem, keyPem, err := GenCertificate()
-			if err != nil {
-				kilolog.Fatal(err)
-			}
+			return tls.Certificate{}, err
+		}
 
-			cert, err = tls.X509KeyPair(certPem, keyPem)
-			if err != nil {
-				kilolog.Fatal(err)
-			}
+		cert, err = tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return tls.Certificate{}, err
 		}
+	}
+
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+
+	kilolog.Info("TLS fingerprint (SHA-256):", hex.EncodeToString(fingerprint[:]))
+
+	return cert, nil
+}
 
-		fingerprint := sha256.Sum256(cert.Certificate[0])
+// Start listens on the given address and accepts connections in the background. With
+// proxyProtocol, every connection must start with a PROXY protocol header, before TLS.
+func (s *Server) Start(port uint16, bind string, isTls bool, proxyProtocol bool) error {
+	s.ConnsMut.Lock()
+	if s.NewConnections == nil {
+		s.NewConnections = make(chan *Connection, 1)
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[string]net.Listener)
+	}
+	s.ConnsMut.Unlock()
 
-		kilolog.Info("TLS fingerprint (SHA-256):", hex.EncodeToString(fingerprint[:]))
+	addr := net.JoinHostPort(bind, strconv.FormatUint(uint64(port), 10))
 
-		listener, err = tls.Listen("tcp", bind+":"+strconv.FormatUint(uint64(port), 10), &tls.Config{
+	var tlsConfig *tls.Config
+	if isTls {
+		cert, err := LoadCertificate()
+		if err != nil {
+			return err
+		}
+
+		tlsConfig = &tls.Config{
 			Certificates: []tls.Certificate{cert},
-		})
-	} else {
-		listener, err = net.Listen("tcp", bind+":"+strconv.FormatUint(uint64(port), 10))
+		}
 	}
+
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		kilolog.Fatal(err)
+		return err
 	}
 
+	s.ConnsMut.Lock()
+	if s.stopped {
+		s.ConnsMut.Unlock()
+		listener.Close()
+		return errors.New("server is stopped")
+	}
+	s.listeners[addr] = listener
+	s.ConnsMut.Unlock()
+
 	kilolog.Info("Stratum server listening on", fmt.Sprintf("%s:%d", bind, port))
 
+	go s.accept(listener, port, tlsConfig, proxyProtocol)
+	return nil
+}
+
+func (s *Server) accept(listener net.Listener, port uint16, tlsConfig *tls.Config, proxyProtocol bool) {
 	for {
 		c, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Println(err)
 			continue
 		}
 
-		kilolog.Info("New incoming connection:", c.RemoteAddr().String())
+		go s.setupConnection(c, port, tlsConfig, proxyProtocol)
+	}
+}
 
-		conn := &Connection{
-			Conn: c,
-			Id:   randomUint64(),
+// setupConnection reads the PROXY header and starts TLS if needed, then hands the
+// connection to the proxy
+func (s *Server) setupConnection(c net.Conn, port uint16, tlsConfig *tls.Config, proxyProtocol bool) {
+	if proxyProtocol {
+		host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		if bind := config.Get().FindBind(port); bind != nil && !bind.TrustsProxy(net.ParseIP(host)) {
+			kilolog.Debug("Refused PROXY connection from untrusted address", c.RemoteAddr().String())
+			c.Close()
+			return
+		}
+		c.SetReadDeadline(time.Now().Add(config.PROXY_HEADER_TIMEOUT_SECONDS * time.Second))
+		pc, err := readProxyHeader(c)
+		if err != nil {
+			kilolog.Debug("Failed to read PROXY header from", c.RemoteAddr().String()+":", err)
+			c.Close()
+			return
 		}
-		go s.handleConnection(conn)
+		c.SetReadDeadline(time.Time{})
+		c = pc
+	}
+	if tlsConfig != nil {
+		c = tls.Server(c, tlsConfig)
+	}
+
+	if s.AllowConnection != nil && !s.AllowConnection(c.RemoteAddr(), port) {
+		kilolog.Debug("Refused incoming connection:", c.RemoteAddr().String())
+		c.Close()
+		return
+	}
+
+	kilolog.Info("New incoming connection:", c.RemoteAddr().String())
+
+	conn := &Connection{
+		Conn:       c,
+		Id:         randomUint64(),
+		BindPort:   port,
+		RemoteAddr: c.RemoteAddr(),
+		Tls:        tlsConfig != nil,
+		Connected:  time.Now(),
+	}
+	s.handleConnection(conn)
+}
+
+// StopListener closes the listener on the given address. Existing connections are left open.
+func (s *Server) StopListener(port uint16, bind string) {
+	s.ConnsMut.Lock()
+	defer s.ConnsMut.Unlock()
+
+	addr := net.JoinHostPort(bind, strconv.FormatUint(uint64(port), 10))
+	if listener := s.listeners[addr]; listener != nil {
+		listener.Close()
+		delete(s.listeners, addr)
+		kilolog.Info("Stratum server stopped listening on", fmt.Sprintf("%s:%d", bind, port))
+	}
+}
+
+// Stop closes all the listeners, so no new connections are accepted.
+// Existing connections are left open.
+func (s *Server) Stop() {
+	s.ConnsMut.Lock()
+	defer s.ConnsMut.Unlock()
+
+	s.stopped = true
+	for _, v := range s.listeners {
+		v.Close()
 	}
+	s.listeners = nil
 }
 
 func (srv *Server) handleConnection(conn *Connection) {
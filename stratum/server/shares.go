@@ -0,0 +1,132 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package stratumserver
+
+import (
+	"kiloproxy/config"
+	"sync"
+	"time"
+)
+
+type Verdict int
+
+const (
+	// VerdictAccepted is a share accepted by the pool, or by the proxy when it doesn't
+	// meet the pool difficulty
+	VerdictAccepted Verdict = iota
+	VerdictRejected
+	VerdictStale
+	VerdictInvalid
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictAccepted:
+		return "accepted"
+	case VerdictRejected:
+		return "rejected"
+	case VerdictStale:
+		return "stale"
+	case VerdictInvalid:
+		return "invalid"
+	}
+	return "unknown"
+}
+
+// ShareCounts is a snapshot of ShareStats. The difficulties are summed by verdict.
+type ShareCounts struct {
+	Accepted     uint64 `json:"accepted"`
+	Rejected     uint64 `json:"rejected"`
+	Stale        uint64 `json:"stale"`
+	Invalid      uint64 `json:"invalid"`
+	AcceptedDiff uint64 `json:"accepted_diff"`
+	RejectedDiff uint64 `json:"rejected_diff"`
+	StaleDiff    uint64 `json:"stale_diff"`
+	InvalidDiff  uint64 `json:"invalid_diff"`
+	// Reasons counts the shares that were not accepted, by reason
+	Reasons map[string]uint64 `json:"reasons"`
+	// LastAccepted is zero if no share was accepted
+	LastAccepted time.Time `json:"-"`
+}
+
+// ShareStats counts shares by verdict, and estimates a hashrate from the accepted ones.
+// It's safe for concurrent use.
+type ShareStats struct {
+	mut    sync.Mutex
+	counts ShareCounts
+	recent HashrateWindow
+}
+
+// Add records a share. The reason of a share that was not accepted is recorded too, up
+// to MAX_REJECT_REASONS distinct reasons, the following ones are counted as "other".
+func (s *ShareStats) Add(v Verdict, diff uint64, reason string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	c := &s.counts
+	switch v {
+	case VerdictAccepted:
+		c.Accepted++
+		c.AcceptedDiff += diff
+		c.LastAccepted = time.Now()
+		s.recent.Add(diff)
+		return
+	case VerdictRejected:
+		c.Rejected++
+		c.RejectedDiff += diff
+	case VerdictStale:
+		c.Stale++
+		c.StaleDiff += diff
+	case VerdictInvalid:
+		c.Invalid++
+		c.InvalidDiff += diff
+	}
+
+	if reason == "" {
+		reason = v.String()
+	}
+	if c.Reasons == nil {
+		c.Reasons = make(map[string]uint64)
+	}
+	if _, ok := c.Reasons[reason]; !ok && len(c.Reasons) >= config.MAX_REJECT_REASONS {
+		reason = "other"
+	}
+	c.Reasons[reason]++
+}
+
+// Counts returns a copy of the counts
+func (s *ShareStats) Counts() ShareCounts {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	c := s.counts
+	c.Reasons = make(map[string]uint64, len(s.counts.Reasons))
+	for k, v := range s.counts.Reasons {
+		c.Reasons[k] = v
+	}
+	return c
+}
+
+// Hashrate returns the hashrate of the accepted shares, see HashrateWindow.Hashrate
+func (s *ShareStats) Hashrate(since time.Time) float64 {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.recent.Hashrate(since)
+}
@@ -58,7 +58,8 @@ type loginReq struct {
 	Pass            string   `json:"pass"`
 	Agent           string   `json:"agent"`
 	Algo            []string `json:"algo"`
-	NicehashSupport bool     `json:"nicehash_support"` // Non-standard. Not supported by XMRIG.
+	RigId           string   `json:"rigid"`
+	NicehashSupport *bool    `json:"nicehash_support"` // Non-standard. Not supported by XMRIG.
 }
 type Response struct {
 	ID      uint64 `json:"id"`
@@ -0,0 +1,216 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package template
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const hashSize = 32
+
+var errTruncated = errors.New("block template is truncated")
+
+// ParsedBlock holds the offsets needed to turn a block template into a hashing blob
+type ParsedBlock struct {
+	// NonceOffset is the offset of the 4-byte nonce, in both the block and the hashing blob
+	NonceOffset int
+	// MinerTxOffset and MinerTxEnd delimit the miner transaction
+	MinerTxOffset int
+	MinerTxEnd    int
+	// MinerTxPrefixEnd is the end of the miner transaction prefix, before the RingCT data
+	MinerTxPrefixEnd int
+	MinerTxVersion   uint64
+
+	TxHashes [][]byte
+}
+
+// ParseBlock parses a Cryptonote block blob, as returned by get_block_template
+func ParseBlock(blob []byte) (*ParsedBlock, error) {
+	b := &ParsedBlock{}
+	r := blobReader{blob: blob}
+
+	// header: major version, minor version, timestamp, previous block hash, nonce
+	r.varint()
+	r.varint()
+	r.varint()
+	r.skip(hashSize)
+	b.NonceOffset = r.pos
+	r.skip(4)
+
+	// miner transaction prefix
+	b.MinerTxOffset = r.pos
+	b.MinerTxVersion = r.varint()
+	r.varint() // unlock time
+
+	numInputs := r.varint()
+	for i := uint64(0); i < numInputs && r.err == nil; i++ {
+		if tag := r.byte(); tag != 0xff {
+			return nil, fmt.Errorf("unexpected miner transaction input type %#x", tag)
+		}
+		r.varint() // height
+	}
+
+	numOutputs := r.varint()
+	for i := uint64(0); i < numOutputs && r.err == nil; i++ {
+		r.varint() // amount
+		switch tag := r.byte(); tag {
+		case 0x02: // txout_to_key
+			r.skip(hashSize)
+		case 0x03: // txout_to_tagged_key
+			r.skip(hashSize + 1)
+		default:
+			return nil, fmt.Errorf("unexpected miner transaction output type %#x", tag)
+		}
+	}
+
+	r.skip(int(r.varint())) // extra
+	b.MinerTxPrefixEnd = r.pos
+
+	if b.MinerTxVersion >= 2 {
+		if rctType := r.byte(); rctType != 0 && r.err == nil {
+			return nil, fmt.Errorf("unexpected miner transaction RingCT type %d", rctType)
+		}
+	}
+	b.MinerTxEnd = r.pos
+
+	numTxs := r.varint()
+	for i := uint64(0); i < numTxs && r.err == nil; i++ {
+		b.TxHashes = append(b.TxHashes, r.bytes(hashSize))
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return b, nil
+}
+
+// HashingBlob returns the blob hashed by the miners: the block header, the merkle root of
+// the transactions and the number of transactions.
+func (b *ParsedBlock) HashingBlob(blob []byte) []byte {
+	hashes := make([][]byte, 0, len(b.TxHashes)+1)
+	hashes = append(hashes, b.minerTxHash(blob))
+	hashes = append(hashes, b.TxHashes...)
+
+	hashingBlob := make([]byte, 0, b.MinerTxOffset+hashSize+binary.MaxVarintLen64)
+	hashingBlob = append(hashingBlob, blob[:b.MinerTxOffset]...)
+	hashingBlob = append(hashingBlob, treeHash(hashes)...)
+	hashingBlob = binary.AppendUvarint(hashingBlob, uint64(len(hashes)))
+	return hashingBlob
+}
+
+func (b *ParsedBlock) minerTxHash(blob []byte) []byte {
+	if b.MinerTxVersion < 2 {
+		return keccak(blob[b.MinerTxOffset:b.MinerTxEnd])
+	}
+	// prefix hash, RingCT base hash, and an empty prunable hash as the RingCT type is null
+	return keccak(
+		keccak(blob[b.MinerTxOffset:b.MinerTxPrefixEnd]),
+		keccak(blob[b.MinerTxPrefixEnd:b.MinerTxEnd]),
+		make([]byte, hashSize),
+	)
+}
+
+func keccak(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, v := range data {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+// treeHash computes the Cryptonote merkle root of the hashes
+func treeHash(hashes [][]byte) []byte {
+	switch len(hashes) {
+	case 1:
+		return hashes[0]
+	case 2:
+		return keccak(hashes[0], hashes[1])
+	}
+
+	// largest power of two lower than the number of hashes
+	cnt := 1
+	for cnt*2 < len(hashes) {
+		cnt *= 2
+	}
+
+	ints := make([][]byte, cnt)
+	direct := 2*cnt - len(hashes)
+	copy(ints, hashes[:direct])
+	for i, j := direct, direct; j < cnt; i, j = i+2, j+1 {
+		ints[j] = keccak(hashes[i], hashes[i+1])
+	}
+	for cnt > 2 {
+		cnt /= 2
+		for i, j := 0, 0; j < cnt; i, j = i+2, j+1 {
+			ints[j] = keccak(ints[i], ints[i+1])
+		}
+	}
+	return keccak(ints[0], ints[1])
+}
+
+type blobReader struct {
+	blob []byte
+	pos  int
+	err  error
+}
+
+func (r *blobReader) skip(n int) {
+	if r.err != nil {
+		return
+	}
+	if n < 0 || r.pos+n > len(r.blob) {
+		r.err = errTruncated
+		return
+	}
+	r.pos += n
+}
+
+func (r *blobReader) bytes(n int) []byte {
+	start := r.pos
+	r.skip(n)
+	if r.err != nil {
+		return nil
+	}
+	return r.blob[start:r.pos]
+}
+
+func (r *blobReader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *blobReader) varint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.blob[r.pos:])
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.pos += n
+	return v
+}
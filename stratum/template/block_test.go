@@ -0,0 +1,202 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package template
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// the Monero mainnet genesis block, and its block ID
+const genesisMinerTx = "013c01ff0001ffffffffffff03029b2e4c0281c0b02e7c53291a94d1d0cbff8883f8024f5142ee494ffbbd08807121017767aafcde9be00dcfd098715ebcf7f410daebc582fda69d24a28e9d0bc890d1"
+const genesisId = "418015bb9ae982a1975da7d79277c2705727a56894ba0fb246adaabb1f4632e3"
+
+func genesisBlock(t *testing.T) []byte {
+	blob, err := hex.DecodeString("010000" + strings.Repeat("00", 32) + "10270000" + genesisMinerTx + "00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+// ringctBlock returns a block with a version 2 miner transaction, as returned by
+// get_block_template since RingCT, and the offset of its 8-byte reserved space
+func ringctBlock(txHashes [][]byte) ([]byte, int) {
+	blob := []byte{16, 16}
+	blob = binary.AppendUvarint(blob, 1700000000)
+	blob = append(blob, bytes.Repeat([]byte{0xab}, 32)...)
+	blob = append(blob, 0, 0, 0, 0)
+
+	blob = append(blob, 2)
+	blob = binary.AppendUvarint(blob, 3000060)
+	blob = append(blob, 1, 0xff)
+	blob = binary.AppendUvarint(blob, 3000000)
+	blob = append(blob, 1)
+	blob = binary.AppendUvarint(blob, 600000000000)
+	blob = append(blob, 0x03)
+	blob = append(blob, bytes.Repeat([]byte{0xcd}, 32)...)
+	blob = append(blob, 0x5a)
+	// extra: tx public key and an 8-byte extra nonce
+	blob = append(blob, 43, 0x01)
+	blob = append(blob, bytes.Repeat([]byte{0xef}, 32)...)
+	blob = append(blob, 0x02, 8)
+	reserved := len(blob)
+	blob = append(blob, make([]byte, 8)...)
+	blob = append(blob, 0)
+
+	blob = binary.AppendUvarint(blob, uint64(len(txHashes)))
+	for _, v := range txHashes {
+		blob = append(blob, v...)
+	}
+	return blob, reserved
+}
+
+func testHashes(n int) [][]byte {
+	hashes := make([][]byte, n)
+	for i := range hashes {
+		hashes[i] = keccak([]byte{byte(i)})
+	}
+	return hashes
+}
+
+func TestParseGenesisBlock(t *testing.T) {
+	blob := genesisBlock(t)
+	b, err := ParseBlock(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.NonceOffset != 35 || b.MinerTxOffset != 39 {
+		t.Errorf("nonce offset %d, miner tx offset %d, expected 35 and 39", b.NonceOffset, b.MinerTxOffset)
+	}
+	if b.MinerTxVersion != 1 || b.MinerTxEnd != len(blob)-1 || b.MinerTxPrefixEnd != b.MinerTxEnd {
+		t.Errorf("miner tx version %d, prefix end %d, end %d", b.MinerTxVersion, b.MinerTxPrefixEnd, b.MinerTxEnd)
+	}
+	if len(b.TxHashes) != 0 {
+		t.Errorf("%d tx hashes, expected none", len(b.TxHashes))
+	}
+
+	hashingBlob := b.HashingBlob(blob)
+	id := keccak(binary.AppendUvarint(nil, uint64(len(hashingBlob))), hashingBlob)
+	if hex.EncodeToString(id) != genesisId {
+		t.Errorf("block id %x, expected %s", id, genesisId)
+	}
+}
+
+func TestParseRingCTBlock(t *testing.T) {
+	hashes := testHashes(3)
+	blob, reserved := ringctBlock(hashes)
+	b, err := ParseBlock(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.MinerTxVersion != 2 {
+		t.Errorf("miner tx version %d, expected 2", b.MinerTxVersion)
+	}
+	if reserved < b.MinerTxOffset || reserved+8 > b.MinerTxPrefixEnd {
+		t.Errorf("reserved offset %d outside of the miner tx prefix %d-%d", reserved, b.MinerTxOffset, b.MinerTxPrefixEnd)
+	}
+	if b.MinerTxEnd != b.MinerTxPrefixEnd+1 {
+		t.Errorf("miner tx end %d, expected %d", b.MinerTxEnd, b.MinerTxPrefixEnd+1)
+	}
+	if len(b.TxHashes) != 3 || !bytes.Equal(b.TxHashes[2], hashes[2]) {
+		t.Fatalf("tx hashes %x, expected %x", b.TxHashes, hashes)
+	}
+
+	minerTxHash := keccak(
+		keccak(blob[b.MinerTxOffset:b.MinerTxPrefixEnd]),
+		keccak([]byte{0}),
+		make([]byte, 32),
+	)
+	expected := append([]byte{}, blob[:b.MinerTxOffset]...)
+	expected = append(expected, keccak(keccak(minerTxHash, hashes[0]), keccak(hashes[1], hashes[2]))...)
+	expected = append(expected, 4)
+	if got := b.HashingBlob(blob); !bytes.Equal(got, expected) {
+		t.Errorf("hashing blob %x, expected %x", got, expected)
+	}
+}
+
+func TestHashingBlobNonce(t *testing.T) {
+	blob, _ := ringctBlock(testHashes(1))
+	b, err := ParseBlock(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := b.HashingBlob(blob)
+	nonce := []byte{0x12, 0x34, 0x56, 0x78}
+	copy(blob[b.NonceOffset:], nonce)
+	after := b.HashingBlob(blob)
+
+	if !bytes.Equal(after[b.NonceOffset:b.NonceOffset+4], nonce) {
+		t.Errorf("nonce %x at offset %d, expected %x", after[b.NonceOffset:b.NonceOffset+4], b.NonceOffset, nonce)
+	}
+	// the nonce is not part of the miner tx, so only the nonce changes
+	copy(before[b.NonceOffset:], nonce)
+	if !bytes.Equal(before, after) {
+		t.Errorf("hashing blob %x, expected %x", after, before)
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+	h := testHashes(5)
+	tests := []struct {
+		name     string
+		hashes   [][]byte
+		expected []byte
+	}{
+		{"1 hash", h[:1], h[0]},
+		{"2 hashes", h[:2], keccak(h[0], h[1])},
+		{"3 hashes", h[:3], keccak(h[0], keccak(h[1], h[2]))},
+		{"4 hashes", h[:4], keccak(keccak(h[0], h[1]), keccak(h[2], h[3]))},
+		{"5 hashes", h[:5], keccak(keccak(h[0], h[1]), keccak(h[2], keccak(h[3], h[4])))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := treeHash(tt.hashes); !bytes.Equal(got, tt.expected) {
+				t.Errorf("tree hash %x, expected %x", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseBlockErrors(t *testing.T) {
+	blob := genesisBlock(t)
+	for i := 0; i < len(blob); i++ {
+		if _, err := ParseBlock(blob[:i]); err == nil {
+			t.Errorf("block truncated to %d bytes parsed without error", i)
+		}
+	}
+
+	badInput := append([]byte{}, blob...)
+	badInput[42] = 0x02 // txin_to_key instead of txin_gen
+	if _, err := ParseBlock(badInput); err == nil {
+		t.Error("miner tx with a key input parsed without error")
+	}
+
+	ringct, _ := ringctBlock(nil)
+	ringct[len(ringct)-2] = 5 // RingCT type of a regular transaction
+	if _, err := ParseBlock(ringct); err == nil {
+		t.Error("miner tx with RingCT signatures parsed without error")
+	}
+}
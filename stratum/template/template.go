@@ -23,6 +23,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"kiloproxy/kilolog"
+	"math"
 	"math/big"
 	"strconv"
 )
@@ -70,7 +71,7 @@ func DiffToTarget(d uint64) []byte {
 	bigInt := big.NewInt(0).Div(bigInt64, minerDiff)
 	buf := bigInt.Bytes()
 	reverse(buf)
-	for len(buf) < 4 {
+	for len(buf) < 8 {
 		buf = append(buf, 0)
 	}
 	return buf
@@ -99,14 +100,43 @@ func init() {
 }
 func HashToDiff(hash []byte) uint64 {
 	var diff = big.NewInt(0).SetBytes(reverse2(hash[:]))
-	if diff.Int64() == 0 {
+	if diff.Sign() == 0 {
 		return 0
 	}
 	diff.Div(&maxTarget, diff)
 	if diff.IsUint64() {
 		return diff.Uint64()
 	}
-	panic(fmt.Sprintf("THIS SHOULD NEVER HAPPEN!!!!! diff is %d", diff))
+	// the hash is better than any uint64 difficulty
+	return math.MaxUint64
+}
+
+// Converts a hex encoded 32-byte result hash to uint64 diff
+func ResultToDiff(result string) (uint64, error) {
+	hash, err := hex.DecodeString(result)
+	if err != nil {
+		return 0, err
+	}
+	if len(hash) != 32 {
+		return 0, fmt.Errorf("invalid result length %d", len(hash))
+	}
+	return HashToDiff(hash), nil
+}
+
+// Converts a hex encoded 4-byte or 8-byte target to uint64 diff
+func TargetToDiff(target string) (uint64, error) {
+	dec, err := hex.DecodeString(target)
+	if err != nil {
+		return 0, err
+	}
+	switch len(dec) {
+	case 4:
+		return ShortDiffToDiff(dec), nil
+	case 8:
+		return MidDiffToDiff(dec), nil
+	default:
+		return 0, fmt.Errorf("invalid target length %d", len(dec))
+	}
 }
 
 // Converts 4-byte short diff to uint64 diff
@@ -25,9 +25,10 @@ import (
 	"kiloproxy/config"
 	"kiloproxy/kilolog"
 	"kiloproxy/mutex"
-	stratumclient "kiloproxy/stratum/client"
 	"kiloproxy/stratum/rpc"
 	stratumserver "kiloproxy/stratum/server"
+	"kiloproxy/stratum/template"
+	"time"
 )
 
 type Upstream struct {
@@ -35,91 +36,320 @@ type Upstream struct {
 
 	TopNicehash byte
 
-	Stratum *stratumclient.Client
+	Stratum PoolClient
+	// ClientId is the ID given by the pool at login
+	ClientId string
 
 	ID uint64
 
-	LastJob rpc.CompleteJob
+	// Group is the name of the pool group, empty for the default group
+	Group string
+	// Pool is the index of the pool in the group, -1 if it was removed from the config
+	Pool int
+	// PoolUrl and PoolTls are the pool settings when the upstream connected
+	PoolUrl string
+	PoolTls bool
+
+	Connected   time.Time
+	LastJob     rpc.CompleteJob
+	LastJobTime time.Time
+
+	// Shares counts the shares of the upstream's miners. PoolShares counts the shares
+	// forwarded to the pool, at pool difficulty, and is shared by all the upstreams of
+	// the same pool url
+	Shares     stratumserver.ShareStats
+	PoolShares *stratumserver.ShareStats
+
+	// Simple is true if the upstream belongs to a single miner that doesn't support
+	// nicehash mode, so the blob is left untouched
+	Simple bool
+
+	// RecentJobs holds the last config.RECENT_JOBS jobs received from the pool, newest last
+	RecentJobs []*RecentJob
+	// PendingJob is the last job received while the jobs are paused, nil otherwise
+	PendingJob *rpc.CompleteJob
+}
+
+type RecentJob struct {
+	JobID string
+
+	// Diff is the pool difficulty of the job
+	Diff uint64
+
+	// Issued holds the nicehash byte and difficulty given to each miner for this job
+	Issued map[uint64]IssuedJob
+
+	// Nonces holds the nonces already submitted for this job
+	Nonces map[string]bool
+}
+
+type IssuedJob struct {
+	Nicehash byte
+	Diff     uint64
+}
+
+// AddJob sets the upstream's current job and adds it to the recent jobs.
+// Note: UpstreamsMut must be locked before calling this
+func (us *Upstream) AddJob(job rpc.CompleteJob) error {
+	diff, err := template.TargetToDiff(job.Target)
+	if err != nil {
+		return err
+	}
+	// the blob is checked here, so GetJob can't fail once the miner joined the upstream
+	if blob, err := hex.DecodeString(job.Blob); err != nil {
+		return err
+	} else if !us.Simple && len(blob) < 44 {
+		return fmt.Errorf("mining blob is too short: %x", blob)
+	}
+
+	if job.Algo != "" {
+		pools := config.Get().GroupPools(us.Group)
+		if us.Pool >= 0 && us.Pool < len(pools) {
+			detectedAlgos[pools[us.Pool].Url] = NormalizeAlgo(job.Algo)
+		}
+	} else {
+		// let the miners know the algorithm when the pool doesn't send it
+		job.Algo = PoolAlgo(us.Group, us.Pool)
+	}
+
+	us.LastJob = job
+	us.LastJobTime = time.Now()
+
+	if len(us.RecentJobs) == config.RECENT_JOBS {
+		us.RecentJobs = us.RecentJobs[1:]
+	}
+	us.RecentJobs = append(us.RecentJobs, &RecentJob{
+		JobID:  job.JobID,
+		Diff:   diff,
+		Issued: make(map[uint64]IssuedJob),
+		Nonces: make(map[string]bool),
+	})
+	return nil
+}
+
+// FindJob returns the recent job with the given ID, or nil if the job is unknown or expired.
+// Note: UpstreamsMut must be locked before calling this
+func (us *Upstream) FindJob(jobId string) *RecentJob {
+	for _, v := range us.RecentJobs {
+		if v.JobID == jobId {
+			return v
+		}
+	}
+	return nil
 }
 
 var Upstreams = make(map[uint64]*Upstream, 100)
 var UpstreamsMut mutex.Mutex
-var LatestUpstream uint64
 
-// GetJob returns a job from the Upstream, the client ID, and the upstream ID
+// LatestUpstream holds, for each pool group, the ID of the upstream new miners join
+var LatestUpstream = make(map[string]uint64)
+var lastUpstreamId uint64
+
+var errNoUpstream = errors.New("no upstream")
+
+// GetJob returns a job from the connection's upstream, or from the latest upstream of its
+// group that has room left, with the client ID and the upstream ID. Returns errNoUpstream
+// if a new upstream must be connected first, see AssignJob.
+// Note: UpstreamsMut must be locked before calling this
 func GetJob(conn *stratumserver.Connection) (rpc.CompleteJob, string, uint64, error) {
-	connClientId := conn.Id
+	us := Upstreams[conn.Upstream]
+	if us == nil {
+		latest := Upstreams[LatestUpstream[conn.Group]]
+		if conn.Simple || latest == nil || latest.TopNicehash == 0xff || latest.Pool != CurrentPool[conn.Group] {
+			// don't connect to a pool the miner can't use
+			if _, err := checkAlgo(conn, PoolAlgo(conn.Group, CurrentPool[conn.Group])); err != nil {
+				return rpc.CompleteJob{}, "", 0, err
+			}
+			return rpc.CompleteJob{}, "", 0, errNoUpstream
+		}
+		kilolog.Debug("Reusing upstream job")
+		us = latest
+	}
+	return us.giveJob(conn)
+}
+
+// giveJob returns a job of the upstream for the connection, adding it to the upstream's
+// clients if needed.
+// Note: UpstreamsMut must be locked before calling this
+func (us *Upstream) giveJob(conn *stratumserver.Connection) (rpc.CompleteJob, string, uint64, error) {
+	theJob := us.LastJob
+
+	// the algorithm is checked before the connection joins the upstream, so an error
+	// leaves the upstream unchanged
+	algo, err := checkAlgo(conn, theJob.Algo)
+	if err != nil {
+		return rpc.CompleteJob{}, "", 0, err
+	}
+	if conn.Upstream != us.ID {
+		// Kick removes the connection from the server before its upstream, a kicked
+		// connection must not join
+		if FindConnection(conn.Id) == nil {
+			return rpc.CompleteJob{}, "", 0, errors.New("miner disconnected")
+		}
+		us.Clients = append(us.Clients, conn.Id)
+		conn.Upstream = us.ID
+	}
+	conn.Algo = algo
 
-	var theJob rpc.CompleteJob
-	var upstreamId uint64
 	var nicehash byte
+	if !conn.Simple {
+		us.TopNicehash++
+		nicehash = us.TopNicehash
 
-	if conn.Upstream != 0 {
-		theJob = Upstreams[conn.Upstream].LastJob
-		upstreamId = conn.Upstream
-		nicehash = Upstreams[conn.Upstream].TopNicehash + 1
-		Upstreams[LatestUpstream].TopNicehash++
-	} else if len(Upstreams) == 0 || Upstreams[LatestUpstream].TopNicehash == 0xff {
-		kilolog.Debug("New upstream connection")
+		kilolog.Debug("Nicehash byte is", hex.EncodeToString([]byte{nicehash}))
 
-		newId := LatestUpstream + 1
-		client := &stratumclient.Client{}
-
-		jobChan, err := client.Connect(
-			config.CFG.Pools[0].Url,
-			config.CFG.Pools[0].Tls,
-			config.CFG.Pools[0].TlsFingerprint,
-			config.USERAGENT,
-			config.CFG.Pools[0].User,
-			config.CFG.Pools[0].Pass,
-		)
-		if err != nil {
-			return rpc.CompleteJob{}, "", 0, err
+		// AddJob checked the blob
+		blobBin, _ := hex.DecodeString(theJob.Blob)
+		blobBin[42] = nicehash
+		theJob.Blob = hex.EncodeToString(blobBin)
+	}
+	conn.Nicehash = nicehash
+
+	recentJob := us.RecentJobs[len(us.RecentJobs)-1]
+
+	Retarget(conn, recentJob.Diff)
+	if conn.Diff < recentJob.Diff {
+		if conn.Diff > 0xffffffff {
+			// the 4-byte target would be 0, no share could meet it
+			theJob.Target = hex.EncodeToString(template.DiffToTarget(conn.Diff))
+		} else {
+			theJob.Target = template.DiffToShortTarget(conn.Diff)
 		}
+	}
 
-		recvJob := <-jobChan
+	recentJob.Issued[conn.Id] = IssuedJob{
+		Nicehash: nicehash,
+		Diff:     conn.Diff,
+	}
 
-		if recvJob == nil {
-			return rpc.CompleteJob{}, "", 0, errors.New("received nil job")
+	return theJob, us.ClientId, us.ID, nil
+}
+
+// checkAlgo returns the normalized algorithm, or errUnsupportedAlgo if the miner doesn't
+// support it
+func checkAlgo(conn *stratumserver.Connection, algo string) (string, error) {
+	algo = NormalizeAlgo(algo)
+	if !SupportsAlgo(conn.Algos, algo) {
+		return "", fmt.Errorf("%w, the pool uses %s", errUnsupportedAlgo, algo)
+	}
+	return algo, nil
+}
+
+// upstreamDial is a pool connection in progress for a new shared upstream
+type upstreamDial struct {
+	done chan struct{}
+	err  error
+}
+
+// dials holds the dials in progress by pool group, so the miners logging in meanwhile
+// wait for the new upstream instead of dialing too. Protected by UpstreamsMut.
+var dials = make(map[string]*upstreamDial)
+
+// AssignJob works like GetJob, but connects a new upstream first if needed.
+// Note: UpstreamsMut must NOT be locked when calling this, the pool is dialed without it
+func AssignJob(conn *stratumserver.Connection) (rpc.CompleteJob, string, uint64, error) {
+	for {
+		UpstreamsMut.Lock()
+		job, clientId, upstreamId, err := GetJob(conn)
+		if !errors.Is(err, errNoUpstream) {
+			UpstreamsMut.Unlock()
+			return job, clientId, upstreamId, err
 		}
 
-		Upstreams[newId] = &Upstream{
-			ID:          newId,
-			Clients:     []uint64{connClientId},
-			TopNicehash: 1,
-			Stratum:     client,
-			LastJob:     *recvJob,
+		if d := dials[conn.Group]; d != nil && !conn.Simple {
+			UpstreamsMut.Unlock()
+			<-d.done
+			if d.err != nil {
+				return rpc.CompleteJob{}, "", 0, d.err
+			}
+			continue
 		}
-		LatestUpstream = newId
+		d := &upstreamDial{done: make(chan struct{})}
+		if !conn.Simple {
+			dials[conn.Group] = d
+		}
+		UpstreamsMut.Unlock()
 
-		go UpstreamHandler(Upstreams[newId], jobChan)
+		kilolog.Debug("New upstream connection")
+		pc, err := ConnectPool(conn.Group)
 
-		theJob = *recvJob
-		upstreamId = newId
-		nicehash = 1
-	} else {
-		kilolog.Debug("Reusing upstream job")
-		upstreamId = LatestUpstream
-		theJob = Upstreams[upstreamId].LastJob
-		nicehash = Upstreams[upstreamId].TopNicehash + 1
-		Upstreams[upstreamId].TopNicehash++
-		Upstreams[upstreamId].Clients = append(Upstreams[upstreamId].Clients, conn.Id)
+		UpstreamsMut.Lock()
+		if dials[conn.Group] == d {
+			delete(dials, conn.Group)
+		}
+		// the waiting miners need UpstreamsMut, they find the new upstream once it's
+		// unlocked
+		d.err = err
+		close(d.done)
+		if err != nil {
+			UpstreamsMut.Unlock()
+			return rpc.CompleteJob{}, "", 0, err
+		}
+
+		us, err := NewUpstream(pc, conn.Group, conn.Simple)
+		if err == nil {
+			job, clientId, upstreamId, err = us.giveJob(conn)
+			if err != nil {
+				// the pool's algorithm may not have been known, or the group failed over
+				// to another pool
+				us.Close()
+			}
+		}
+		UpstreamsMut.Unlock()
+		return job, clientId, upstreamId, err
 	}
-	kilolog.Debug("Nicehash byte is", hex.EncodeToString([]byte{nicehash}))
+}
 
-	blobBin, err := hex.DecodeString(theJob.Blob)
+// NewUpstream returns a new upstream without clients, using the pool connection. Simple
+// upstreams are never shared.
+// Note: UpstreamsMut must be locked before calling this
+func NewUpstream(pc *PoolConn, group string, simple bool) (*Upstream, error) {
+	lastUpstreamId++
+
+	us := &Upstream{
+		ID:         lastUpstreamId,
+		Stratum:    pc.Client,
+		ClientId:   pc.ClientId,
+		Group:      group,
+		Pool:       -1,
+		PoolUrl:    pc.Pool.Url,
+		PoolTls:    pc.Pool.Tls,
+		Connected:  time.Now(),
+		Simple:     simple,
+		PoolShares: PoolShares(pc.Pool.Url),
+	}
+	// the config may have been reloaded while dialing
+	for i, v := range config.Get().GroupPools(group) {
+		if v.Url == pc.Pool.Url {
+			us.Pool = i
+			break
+		}
+	}
+	err := us.AddJob(*pc.Job)
 	if err != nil {
-		return rpc.CompleteJob{}, "", 0, err
+		pc.Client.Close()
+		return nil, err
 	}
-	if len(blobBin) < 44 {
-		return rpc.CompleteJob{}, "", 0, fmt.Errorf("mining blob is too short: %x", blobBin)
+	Upstreams[us.ID] = us
+	if !us.Simple {
+		LatestUpstream[group] = us.ID
 	}
 
-	blobBin[42] = nicehash
-
-	theJob.Blob = hex.EncodeToString(blobBin)
-
-	return theJob, Upstreams[upstreamId].Stratum.ClientId, upstreamId, nil
+	PublishEvent(Event{
+		Type:     EventUpstreamConnected,
+		Upstream: us.ID,
+		Data: map[string]any{
+			"group":     us.Group,
+			"pool":      us.Pool,
+			"pool_url":  us.PoolUrl,
+			"client_id": us.ClientId,
+			"simple":    us.Simple,
+		},
+	})
+
+	go UpstreamHandler(us, pc.JobChan)
+
+	return us, nil
 }
 
 func UpstreamHandler(us *Upstream, jobChan <-chan *rpc.CompleteJob) {
@@ -127,14 +357,34 @@ func UpstreamHandler(us *Upstream, jobChan <-chan *rpc.CompleteJob) {
 		recvJob := <-jobChan
 
 		if recvJob == nil {
-			if us.Stratum.IsAlive() {
+			alive := us.Stratum.IsAlive()
+			if alive {
 				kilolog.Warn("recvJob is nil")
 			} else {
 				kilolog.Debug("recvJob is nil")
 			}
+			if ShuttingDown() {
+				return
+			}
+
 			UpstreamsMut.Lock()
+			if alive {
+				// the pool dropped the connection
+				PoolFailed(us.Group, us.Pool)
+				PublishEvent(Event{
+					Type:     EventUpstreamLost,
+					Upstream: us.ID,
+					Data:     map[string]any{"clients": len(us.Clients)},
+				})
+			}
+			clients := us.Clients
+			us.Clients = nil
 			us.Close()
 			UpstreamsMut.Unlock()
+
+			if len(clients) > 0 {
+				MigrateClients(clients)
+			}
 			return
 		}
 
@@ -144,49 +394,224 @@ func UpstreamHandler(us *Upstream, jobChan <-chan *rpc.CompleteJob) {
 	}
 }
 
-// upstream must be locked before closing
-func (us *Upstream) Close() {
+// MigrateClients moves the given connections, whose upstream is gone, to another
+// upstream and sends them a fresh job. Connections are kicked only if no pool can
+// be reached after MIGRATE_ATTEMPTS attempts.
+func MigrateClients(clients []uint64) {
+	kilolog.Info("Migrating", len(clients), "miners to a new upstream")
+
+	for attempt := 1; len(clients) > 0; attempt++ {
+		failed := make([]uint64, 0, len(clients))
+		// the pools of a group are dialed once per attempt, the other miners of a group
+		// that failed wait for the next attempt
+		failedGroups := make(map[string]bool)
+
+		for _, id := range clients {
+			conn := FindConnection(id)
+			if conn == nil {
+				// the miner disconnected in the meantime
+				continue
+			}
+			if failedGroups[conn.Group] {
+				failed = append(failed, id)
+				continue
+			}
 
-	us.Stratum.Close()
+			conn.Lock()
+			jobData, _, _, err := AssignJob(conn)
+			if err == nil {
+				sendJob(conn, jobData)
+			}
+			conn.Unlock()
+
+			if errors.Is(err, errUnsupportedAlgo) {
+				kilolog.Warn("Failed to migrate miner:", err)
+				KickFor(id, "unsupported algorithm")
+			} else if err != nil {
+				kilolog.Warn("Failed to migrate miner:", err)
+				failedGroups[conn.Group] = true
+				failed = append(failed, id)
+			}
+		}
 
-	Upstreams[us.ID] = nil
+		if len(failed) > 0 && attempt >= config.MIGRATE_ATTEMPTS {
+			kilolog.Err("Could not migrate", len(failed), "miners, kicking them")
+			for _, id := range failed {
+				KickFor(id, "migration failed")
+			}
+			return
+		}
+
+		clients = failed
+		if len(clients) > 0 {
+			time.Sleep(config.MIGRATE_RETRY_SECONDS * time.Second)
+		}
+	}
+}
+
+// FindConnection returns the server connection with the given ID, or nil
+func FindConnection(id uint64) *stratumserver.Connection {
+	srv.ConnsMut.Lock()
+	defer srv.ConnsMut.Unlock()
+
+	for _, conn := range srv.Connections {
+		if conn.Id == id {
+			return conn
+		}
+	}
+	return nil
+}
+
+// RemoveClient removes a connection from the upstream's clients, and closes the
+// upstream if it has no clients left.
+// Note: UpstreamsMut must be locked before calling this
+func RemoveClient(upstreamId uint64, connId uint64) {
+	us := Upstreams[upstreamId]
+	if us == nil {
+		return
+	}
 
-	if LatestUpstream == us.ID {
-		if len(Upstreams) == 1 {
-			kilolog.Debug("Last upstream destroyed.")
-			LatestUpstream = 0
+	for i, v := range us.Clients {
+		if v == connId {
+			us.Clients = append(us.Clients[:i], us.Clients[i+1:]...)
+			break
 		}
 	}
 
-	delete(Upstreams, us.ID)
+	// If upstream is empty, close it
+	if len(us.Clients) == 0 {
+		us.Close()
+	}
+}
+
+// Note: UpstreamsMut must be locked before calling this
+func (us *Upstream) Close() {
+	us.Stratum.Close()
+
+	if Upstreams[us.ID] == us {
+		delete(Upstreams, us.ID)
+		PublishEvent(Event{Type: EventUpstreamClosed, Upstream: us.ID})
+	}
 }
 
 func HandleUpstreamJob(us *Upstream, job *rpc.CompleteJob) {
-	kilolog.Debug("New job for Upstream", us.ID)
+	kilolog.With("upstream", us.ID, "job", job.JobID).Debug("New job for upstream")
+
+	startTime := time.Now()
 
 	UpstreamsMut.Lock()
-	defer UpstreamsMut.Unlock()
 
-	kilolog.Debug("New job for Upstream", us.ID, "part 2 TODO")
+	if jobsPaused {
+		// the miners keep working on the recent jobs, they must not expire until resumed
+		us.PendingJob = job
+		UpstreamsMut.Unlock()
+		diff, _ := template.TargetToDiff(job.Target)
+		publishJob(us.ID, job, diff, true)
+		kilolog.Debug("Job distribution is paused, keeping the job")
+		return
+	}
 
-	us.TopNicehash = 0
+	err := us.AddJob(*job)
+	if err != nil {
+		UpstreamsMut.Unlock()
+		kilolog.Warn("Invalid job from pool:", err)
+		return
+	}
+	publishJob(us.ID, &us.LastJob, us.RecentJobs[len(us.RecentJobs)-1].Diff, false)
 
-	us.LastJob = *job
+	kicked := broadcastJob(us)
 
+	UpstreamsMut.Unlock()
+
+	jobBroadcastLatency.ObserveSince(startTime)
+
+	for _, v := range kicked {
+		KickFor(v, "job update failed")
+	}
+}
+
+func publishJob(upstreamId uint64, job *rpc.CompleteJob, diff uint64, paused bool) {
+	PublishEvent(Event{
+		Type:     EventJob,
+		Upstream: upstreamId,
+		Data: map[string]any{
+			"job_id": job.JobID,
+			"height": job.Height,
+			"diff":   diff,
+			"algo":   job.Algo,
+			"paused": paused,
+		},
+	})
+}
+
+// jobsPaused is true when the new jobs are not sent to the miners, protected by UpstreamsMut
+var jobsPaused bool
+
+// broadcastJob sends the upstream's last job to its clients, and returns the clients that
+// must be kicked.
+// Note: UpstreamsMut must be locked before calling this
+func broadcastJob(us *Upstream) []uint64 {
+	us.TopNicehash = 0
+
+	kicked := make([]uint64, 0)
 	for _, v := range us.Clients {
-		kilolog.Debug("Sending to client", v)
-		srv.ConnsMut.Lock()
-		kilolog.Debug("Sending part 2")
-
-		//innerloop:
-		for _, conn := range srv.Connections {
-			if conn.Id == v {
-				kilolog.Debug("Refreshing job for connection", conn.Id)
-				GetNewJob(conn, us.LastJob)
-				//break innerloop
+		conn := FindConnection(v)
+		if conn == nil {
+			continue
+		}
+
+		kilolog.With("miner", conn.Id, "upstream", us.ID).Debug("Refreshing job for connection")
+		err := GetNewJob(conn)
+		if err != nil {
+			kilolog.Warn(err)
+			kicked = append(kicked, conn.Id)
+		}
+	}
+	return kicked
+}
+
+// PauseJobs stops or resumes sending the new jobs to the miners. While paused, the recent
+// jobs of the upstreams don't change, so the shares of the held miners are not stale. When
+// resuming, the miners get the last job of their upstream.
+func PauseJobs(pause bool) {
+	UpstreamsMut.Lock()
+	if jobsPaused == pause {
+		UpstreamsMut.Unlock()
+		return
+	}
+	jobsPaused = pause
+
+	kicked := make([]uint64, 0)
+	if !pause {
+		for _, us := range Upstreams {
+			if us.PendingJob != nil {
+				err := us.AddJob(*us.PendingJob)
+				us.PendingJob = nil
+				if err != nil {
+					kilolog.Warn("Invalid job from pool:", err)
+					continue
+				}
 			}
+			kicked = append(kicked, broadcastJob(us)...)
 		}
+	}
+	UpstreamsMut.Unlock()
+
+	for _, v := range kicked {
+		KickFor(v, "job update failed")
+	}
+}
+
+// ReconnectUpstream closes the upstream, its clients are migrated to a new one
+func ReconnectUpstream(id uint64) error {
+	UpstreamsMut.Lock()
+	defer UpstreamsMut.Unlock()
 
-		srv.ConnsMut.Unlock()
+	us := Upstreams[id]
+	if us == nil {
+		return errors.New("unknown upstream")
 	}
+	// the upstream handler migrates the clients
+	us.Close()
+	return nil
 }
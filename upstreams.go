@@ -0,0 +1,117 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	daemonclient "kiloproxy/stratum/daemon"
+	stratumserver "kiloproxy/stratum/server"
+	"sort"
+	"time"
+)
+
+type UpstreamJobInfo struct {
+	JobID  string `json:"job_id"`
+	Height uint64 `json:"height"`
+	Target string `json:"target"`
+	Diff   uint64 `json:"diff"`
+	Algo   string `json:"algo"`
+	// Age is the number of seconds since the job was received
+	Age int64 `json:"age"`
+}
+
+type UpstreamInfo struct {
+	Id          uint64 `json:"id"`
+	Group       string `json:"group"`
+	Pool        int    `json:"pool"`
+	PoolUrl     string `json:"pool_url"`
+	Tls         bool   `json:"tls"`
+	Fingerprint string `json:"fingerprint"`
+	Daemon      bool   `json:"daemon"`
+	Alive       bool   `json:"alive"`
+	ClientId    string `json:"client_id"`
+	Simple      bool   `json:"simple"`
+
+	Clients int `json:"clients"`
+	// nicehash slots, both 0 for simple upstreams
+	UsedSlots int `json:"used_slots"`
+	FreeSlots int `json:"free_slots"`
+
+	Job UpstreamJobInfo `json:"job"`
+
+	// Connected is a unix timestamp
+	Connected int64                     `json:"connected"`
+	Shares    stratumserver.ShareCounts `json:"shares"`
+	// Hashrate is estimated from the shares of the upstream's miners accepted since it
+	// connected
+	Hashrate float64 `json:"hashrate"`
+}
+
+// ListUpstreams returns the upstreams, sorted by ID
+func ListUpstreams() []UpstreamInfo {
+	UpstreamsMut.Lock()
+	list := make([]*Upstream, 0, len(Upstreams))
+	for _, us := range Upstreams {
+		list = append(list, us)
+	}
+
+	infos := make([]UpstreamInfo, 0, len(list))
+	for _, us := range list {
+		info := UpstreamInfo{
+			Id:       us.ID,
+			Group:    us.Group,
+			Pool:     us.Pool,
+			PoolUrl:  us.PoolUrl,
+			Tls:      us.PoolTls,
+			ClientId: us.ClientId,
+			Simple:   us.Simple,
+			Clients:  len(us.Clients),
+			Job: UpstreamJobInfo{
+				JobID:  us.LastJob.JobID,
+				Height: us.LastJob.Height,
+				Target: us.LastJob.Target,
+				Algo:   us.LastJob.Algo,
+				Age:    int64(time.Since(us.LastJobTime).Seconds()),
+			},
+			Connected: us.Connected.Unix(),
+			Shares:    us.Shares.Counts(),
+			Hashrate:  us.Shares.Hashrate(us.Connected),
+		}
+		if len(us.RecentJobs) > 0 {
+			info.Job.Diff = us.RecentJobs[len(us.RecentJobs)-1].Diff
+		}
+		if !us.Simple {
+			info.UsedSlots = int(us.TopNicehash)
+			info.FreeSlots = 0xff - int(us.TopNicehash)
+		}
+		infos = append(infos, info)
+	}
+	UpstreamsMut.Unlock()
+
+	// the pool clients have their own locks, don't hold UpstreamsMut while asking them
+	for i, us := range list {
+		_, infos[i].Daemon = us.Stratum.(*daemonclient.Client)
+		infos[i].Fingerprint = us.Stratum.Fingerprint()
+		infos[i].Alive = us.Stratum.IsAlive()
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+	return infos
+}
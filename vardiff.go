@@ -0,0 +1,91 @@
+/*
+ * Kiloproxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Kilopool.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"kiloproxy/config"
+	"kiloproxy/kilolog"
+	stratumserver "kiloproxy/stratum/server"
+	"math"
+	"time"
+)
+
+// Retarget updates the miner difficulty from the share rate observed since the last
+// retarget. The difficulty never exceeds the pool difficulty. It's called every time
+// a job is sent to the miner, so the new difficulty applies to the next job.
+// Note: UpstreamsMut must be locked before calling this
+func Retarget(conn *stratumserver.Connection, poolDiff uint64) {
+	cfg := config.Get().VarDiff
+
+	if conn.LastRetarget.IsZero() {
+		conn.LastRetarget = time.Now()
+		conn.Diff = clampDiff(cfg.StartDiff, poolDiff)
+		return
+	}
+
+	elapsed := time.Since(conn.LastRetarget).Seconds()
+	if elapsed < cfg.RetargetTime || elapsed < config.HASHRATE_MIN_SECONDS {
+		conn.Diff = clampDiff(conn.Diff, poolDiff)
+		return
+	}
+
+	newDiff := float64(conn.Diff)
+	if conn.Shares == 0 {
+		newDiff /= config.VARDIFF_MAX_CHANGE
+	} else {
+		shareTime := elapsed / float64(conn.Shares)
+		variance := cfg.TargetTime * cfg.Variance / 100
+
+		if math.Abs(shareTime-cfg.TargetTime) > variance {
+			ratio := cfg.TargetTime / shareTime
+			ratio = math.Max(ratio, 1/config.VARDIFF_MAX_CHANGE)
+			ratio = math.Min(ratio, config.VARDIFF_MAX_CHANGE)
+			newDiff *= ratio
+		}
+	}
+
+	conn.Shares = 0
+	conn.LastRetarget = time.Now()
+
+	diff := clampDiff(uint64(newDiff), poolDiff)
+	if diff != conn.Diff {
+		kilolog.Debug("Retargeting miner", conn.Id, "from", conn.Diff, "to", diff)
+	}
+	conn.Diff = diff
+}
+
+// clampDiff limits the diff to the vardiff limits and to the pool difficulty
+func clampDiff(diff uint64, poolDiff uint64) uint64 {
+	cfg := config.Get().VarDiff
+
+	if !cfg.Enabled {
+		return poolDiff
+	}
+
+	if diff < cfg.MinDiff {
+		diff = cfg.MinDiff
+	}
+	if cfg.MaxDiff != 0 && diff > cfg.MaxDiff {
+		diff = cfg.MaxDiff
+	}
+	if diff > poolDiff {
+		diff = poolDiff
+	}
+	return diff
+}